@@ -0,0 +1,131 @@
+package bottin
+
+import (
+	"testing"
+	"time"
+
+	"github.com/kakwa/bottin/bottintest"
+	"github.com/nbio/st"
+)
+
+// The hierarchy of newBailiwickResolver, where the nameserver of evil.com. sends glue for a name of
+// bank.com. along with a referral.
+const (
+	bailiwickHints = `
+.                   3600000 IN NS a.root.test.
+a.root.test.        3600000 IN A  192.0.2.1
+`
+	bailiwickRootZone = `
+.                   86400 IN SOA a.root.test. hostmaster.root.test. 1 1800 900 604800 86400
+.                   86400 IN NS  a.root.test.
+com.                86400 IN NS  ns.com.
+ns.com.             86400 IN A   192.0.2.2
+`
+	bailiwickComZone = `
+com.                3600  IN SOA ns.com. hostmaster.com. 1 1800 900 604800 300
+com.                3600  IN NS  ns.com.
+evil.com.           3600  IN NS  ns.evil.com.
+ns.evil.com.        3600  IN A   192.0.2.3
+bank.com.           3600  IN NS  ns.bank.com.
+ns.bank.com.        3600  IN A   192.0.2.4
+`
+	bailiwickEvilZone = `
+evil.com.           3600  IN SOA ns.evil.com. hostmaster.evil.com. 1 1800 900 604800 300
+evil.com.           3600  IN NS  ns.evil.com.
+sub.evil.com.       3600  IN NS  ns.bank.com.
+ns.bank.com.        3600  IN A   203.0.113.66
+`
+	bailiwickBankZone = `
+bank.com.           3600  IN SOA ns.bank.com. hostmaster.bank.com. 1 1800 900 604800 300
+bank.com.           3600  IN NS  ns.bank.com.
+ns.bank.com.        3600  IN A   192.0.2.4
+`
+	bailiwickSubZone = `
+sub.evil.com.       3600  IN SOA ns.bank.com. hostmaster.evil.com. 1 1800 900 604800 300
+sub.evil.com.       3600  IN NS  ns.bank.com.
+www.sub.evil.com.   3600  IN A   198.51.100.1
+`
+)
+
+func newBailiwickResolver(t *testing.T) *BottinResolver {
+	n := bottintest.NewNetwork()
+	add := func(addr string, zones ...string) {
+		srv, err := bottintest.NewServer(zones...)
+		st.Assert(t, err, nil)
+		n.Add(srv, addr)
+	}
+	add("192.0.2.1", bailiwickRootZone)
+	add("192.0.2.2", bailiwickComZone)
+	add("192.0.2.3", bailiwickEvilZone)
+	add("192.0.2.4", bailiwickBankZone, bailiwickSubZone)
+	return NewResolver(WithExchanger(n), WithRootHints(bailiwickHints), WithExpiry())
+}
+
+func TestBailiwickGlue(t *testing.T) {
+	r := newBailiwickResolver(t)
+	rrs, err := r.ResolveErr("www.sub.evil.com", "A")
+	st.Expect(t, err, nil)
+	st.Expect(t, count(rrs.AnswerRRs, func(rr RR) bool { return rr.Value == "198.51.100.1" }), 1)
+
+	// The glue of evil.com. for ns.bank.com. is dropped, its address comes from bank.com.
+	glue, ok := r.cache.Get("ns.bank.com.|A")
+	st.Expect(t, ok, true)
+	st.Expect(t, len(glue), 1)
+	st.Expect(t, glue[0].Value, "192.0.2.4")
+}
+
+func TestCacheRanks(t *testing.T) {
+	c := NewCache()
+	ns := func(value string) []RR {
+		return []RR{{Name: "example.com.", Type: "NS", Value: value, TTL: time.Hour}}
+	}
+	st.Expect(t, c.SetRanked("example.com.|NS", ns("ns1.example.com."), RankAuthority), true)
+	st.Expect(t, c.SetRanked("example.com.|NS", ns("ns2.example.com."), RankAuthAnswer), true)
+	st.Expect(t, c.SetRanked("example.com.|NS", ns("ns3.example.com."), RankAuthority), false)
+	st.Expect(t, c.SetRanked("example.com.|NS", ns("ns4.example.com."), RankAdditional), false)
+	rrs, _ := c.Get("example.com.|NS")
+	st.Expect(t, rrs[0].Value, "ns2.example.com.")
+
+	// Equal ranks replace each other, and Set overrides ranks.
+	st.Expect(t, c.SetRanked("example.com.|NS", ns("ns5.example.com."), RankAuthAnswer), true)
+	c.Set("example.com.|NS", ns("ns6.example.com."))
+	rrs, _ = c.Get("example.com.|NS")
+	st.Expect(t, rrs[0].Value, "ns6.example.com.")
+
+	// Pinned entries are kept.
+	c.SetPinned("a.root-servers.net.|A", []RR{{Name: "a.root-servers.net.", Type: "A", Value: "198.41.0.4"}})
+	st.Expect(t, c.SetRanked("a.root-servers.net.|A", testRRs("a.root-servers.net."), RankAuthAnswer), false)
+}
+
+func TestCacheRanksExpired(t *testing.T) {
+	clock := bottintest.NewClock(time.Now())
+	c := NewCache(WithCacheClock(clock))
+	c.SetRanked("a.|A", []RR{{Name: "a.", Type: "A", Value: "192.0.2.1", TTL: time.Minute}}, RankAuthAnswer)
+	clock.Advance(time.Minute)
+	st.Expect(t, c.SetRanked("a.|A", []RR{{Name: "a.", Type: "A", Value: "192.0.2.2", TTL: time.Minute}}, RankAdditional), true)
+	rrs, _ := c.Get("a.|A")
+	st.Expect(t, rrs[0].Value, "192.0.2.2")
+}
+
+func TestCacheGlueNotAnswered(t *testing.T) {
+	n := newSignedNetwork(t)
+	r := n.resolver()
+
+	_, err := r.ResolveErr("www.example", "A")
+	st.Expect(t, err, nil)
+	st.Expect(t, r.cache.Rank("ns.example.|A"), RankAdditional)
+
+	// The glue of the referral to example. is in the cache, but the answer comes from the zone.
+	queries := n.example.Queries()
+	rrs, err := r.ResolveErr("ns.example", "A")
+	st.Expect(t, err, nil)
+	st.Expect(t, n.example.Queries(), queries+1)
+	st.Expect(t, rrs.Security, Secure)
+	st.Expect(t, r.cache.Rank("ns.example.|A"), RankAuthAnswer)
+
+	// From the cache.
+	rrs, err = r.ResolveErr("ns.example", "A")
+	st.Expect(t, err, nil)
+	st.Expect(t, n.example.Queries(), queries+1)
+	st.Expect(t, rrs.Security, Secure)
+}
@@ -0,0 +1,274 @@
+package bottintest
+
+import (
+	"crypto"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Key is a DNSSEC key of a zone, to sign it with Server.Sign.
+type Key struct {
+	DNSKEY *dns.DNSKEY
+	signer crypto.Signer
+}
+
+// NewKey generates an ECDSA P-256 key for zone, a key-signing key (with the SEP flag) if ksk is set.
+func NewKey(zone string, ksk bool) (*Key, error) {
+	dnskey := &dns.DNSKEY{
+		Hdr:       dns.RR_Header{Name: dns.Fqdn(strings.ToLower(zone)), Rrtype: dns.TypeDNSKEY, Class: dns.ClassINET, Ttl: 3600},
+		Flags:     dns.ZONE,
+		Protocol:  3,
+		Algorithm: dns.ECDSAP256SHA256,
+	}
+	if ksk {
+		dnskey.Flags |= dns.SEP
+	}
+	priv, err := dnskey.Generate(256)
+	if err != nil {
+		return nil, err
+	}
+	return &Key{DNSKEY: dnskey, signer: priv.(crypto.Signer)}, nil
+}
+
+// Revoke sets the REVOKE flag of the key (RFC 5011 section 2.1), which changes its key tag. The
+// zones signed with it afterwards publish it revoked.
+func (k *Key) Revoke() {
+	k.DNSKEY.Flags |= dns.REVOKE
+}
+
+// DS returns the DS record of the key, for the parent zone or as a trust anchor.
+func (k *Key) DS() *dns.DS {
+	return k.DNSKEY.ToDS(dns.SHA256)
+}
+
+// Sign signs the zone of the server with origin: it adds the DNSKEY records of keys at its apex, an
+// NSEC chain, and signatures valid from an hour ago for Validity. Key-signing keys sign the
+// DNSKEY RRset, and the other keys, if any, the other RRsets. The server then answers queries with
+// the DO bit with the signatures, DS records of its delegations and NSEC proofs of nonexistence.
+// The DS records of the signed child zones must be in the zone before it is signed.
+func (s *Server) Sign(origin string, keys ...*Key) error {
+	origin = dns.Fqdn(strings.ToLower(origin))
+	var z *zone
+	for _, candidate := range s.zones {
+		if candidate.origin == origin {
+			z = candidate
+		}
+	}
+	if z == nil {
+		return fmt.Errorf("bottintest: no zone %s", origin)
+	}
+	for _, key := range keys {
+		z.records[origin] = append(z.records[origin], dns.Copy(key.DNSKEY))
+	}
+
+	// Names of the zone in the canonical order, without the glue below its delegations.
+	var names []string
+	for name := range z.records {
+		if !z.glue(name) {
+			names = append(names, name)
+		}
+	}
+	sort.Slice(names, func(i, j int) bool { return canonicalCompare(names[i], names[j]) < 0 })
+	soa := z.rrs(origin, dns.TypeSOA)[0].(*dns.SOA)
+	for i, name := range names {
+		nsec := &dns.NSEC{
+			Hdr:        dns.RR_Header{Name: name, Rrtype: dns.TypeNSEC, Class: dns.ClassINET, Ttl: soa.Minttl},
+			NextDomain: names[(i+1)%len(names)],
+			TypeBitMap: []uint16{dns.TypeNSEC, dns.TypeRRSIG},
+		}
+		for _, rr := range z.records[name] {
+			nsec.TypeBitMap = append(nsec.TypeBitMap, rr.Header().Rrtype)
+		}
+		sort.Slice(nsec.TypeBitMap, func(i, j int) bool { return nsec.TypeBitMap[i] < nsec.TypeBitMap[j] })
+		nsec.TypeBitMap = dedup(nsec.TypeBitMap)
+		z.records[name] = append(z.records[name], nsec)
+	}
+
+	var ksks, zsks []*Key
+	for _, key := range keys {
+		if key.DNSKEY.Flags&dns.SEP != 0 {
+			ksks = append(ksks, key)
+		} else {
+			zsks = append(zsks, key)
+		}
+	}
+	if len(zsks) == 0 {
+		zsks = ksks
+	}
+	now := time.Now()
+	validity := s.Validity
+	if validity == 0 {
+		validity = 30 * 24 * time.Hour
+	}
+	for _, name := range names {
+		cut := name != origin && len(z.rrs(name, dns.TypeNS)) > 0
+		var types []uint16
+		for _, rr := range z.records[name] {
+			t := rr.Header().Rrtype
+			if !(cut && t == dns.TypeNS) && !hasType(types, t) {
+				types = append(types, t) // The NS records of delegations aren't signed.
+			}
+		}
+		for _, t := range types {
+			signers := zsks
+			if t == dns.TypeDNSKEY {
+				signers = ksks
+			}
+			for _, key := range signers {
+				rrset := z.rrs(name, t)
+				sig := &dns.RRSIG{
+					Hdr:        dns.RR_Header{Ttl: rrset[0].Header().Ttl},
+					Algorithm:  key.DNSKEY.Algorithm,
+					Inception:  uint32(now.Add(-time.Hour).Unix()),
+					Expiration: uint32(now.AddDate(1, 0, 0).Unix()),
+					KeyTag:     key.DNSKEY.KeyTag(),
+					SignerName: origin,
+				}
+				if err := sig.Sign(key.signer, rrset); err != nil {
+					return err
+				}
+				z.records[name] = append(z.records[name], sig)
+			}
+		}
+	}
+	z.signed = true
+	return nil
+}
+
+// sigs returns copies of the signatures of the RRset of the zone with the given owner and type.
+func (z *zone) sigs(name string, rrtype uint16) []dns.RR {
+	var sigs []dns.RR
+	for _, rr := range z.records[name] {
+		if sig, ok := rr.(*dns.RRSIG); ok && sig.TypeCovered == rrtype {
+			sigs = append(sigs, dns.Copy(sig))
+		}
+	}
+	return sigs
+}
+
+// glue reports whether name is below a delegation of the zone, where the zone isn't authoritative.
+func (z *zone) glue(name string) bool {
+	for cut, ok := parentName(name); ok && dns.IsSubDomain(z.origin, cut) && cut != z.origin; cut, ok = parentName(cut) {
+		if len(z.rrs(cut, dns.TypeNS)) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// sign adds the signatures of the RRsets of the answer and authority sections of resp.
+func (z *zone) sign(resp *dns.Msg) {
+	sign := func(section []dns.RR) []dns.RR {
+		type rrset struct {
+			name   string
+			rrtype uint16
+		}
+		seen := make(map[rrset]bool)
+		for _, rr := range section {
+			set := rrset{strings.ToLower(rr.Header().Name), rr.Header().Rrtype}
+			if !seen[set] {
+				seen[set] = true
+				section = append(section, z.sigs(set.name, set.rrtype)...)
+			}
+		}
+		return section
+	}
+	resp.Answer = sign(resp.Answer)
+	resp.Ns = sign(resp.Ns)
+}
+
+// nsec returns the NSEC record of the zone owned by name, or covering it if cover is set.
+func (z *zone) nsec(name string, cover bool) *dns.NSEC {
+	for _, rrs := range z.records {
+		for _, rr := range rrs {
+			nsec, ok := rr.(*dns.NSEC)
+			if !ok {
+				continue
+			}
+			owner, next := nsec.Hdr.Name, nsec.NextDomain
+			if !cover && owner == name {
+				return dns.Copy(nsec).(*dns.NSEC)
+			}
+			if cover && canonicalCompare(owner, name) < 0 && (canonicalCompare(name, next) < 0 || canonicalCompare(next, owner) <= 0) {
+				return dns.Copy(nsec).(*dns.NSEC)
+			}
+		}
+	}
+	return nil
+}
+
+// deny adds to resp the NSEC records proving that name doesn't exist, if nxdomain is set, or that it
+// has no records of the queried type.
+func (z *zone) deny(resp *dns.Msg, name string, nxdomain bool) {
+	add := func(nsec *dns.NSEC) {
+		for _, rr := range resp.Ns {
+			if rr.Header().Rrtype == dns.TypeNSEC && rr.Header().Name == nsec.Hdr.Name {
+				return
+			}
+		}
+		resp.Ns = append(resp.Ns, nsec)
+	}
+	if !nxdomain {
+		if nsec := z.nsec(name, false); nsec != nil {
+			add(nsec)
+		} else if nsec := z.nsec(name, true); nsec != nil {
+			add(nsec) // Empty non-terminal.
+		}
+		return
+	}
+	cover := z.nsec(name, true)
+	if cover == nil {
+		return
+	}
+	add(cover)
+	// No wildcard of the closest encloser either.
+	labels := max(dns.CompareDomainName(name, cover.Hdr.Name), dns.CompareDomainName(name, cover.NextDomain))
+	parts := dns.SplitDomainName(name)
+	wildcard := dns.Fqdn("*." + strings.Join(parts[len(parts)-labels:], "."))
+	if nsec := z.nsec(wildcard, true); nsec != nil {
+		add(nsec)
+	}
+}
+
+// canonicalCompare compares the names a and b in the canonical DNS name order (RFC 4034 section 6.1).
+func canonicalCompare(a, b string) int {
+	la := dns.SplitDomainName(strings.ToLower(a))
+	lb := dns.SplitDomainName(strings.ToLower(b))
+	for i := 1; i <= len(la) && i <= len(lb); i++ {
+		if c := strings.Compare(la[len(la)-i], lb[len(lb)-i]); c != 0 {
+			return c
+		}
+	}
+	return len(la) - len(lb)
+}
+
+func parentName(name string) (string, bool) {
+	labels := dns.SplitDomainName(name)
+	if labels == nil {
+		return "", false
+	}
+	return dns.Fqdn(strings.Join(labels[1:], ".")), true
+}
+
+func hasType(types []uint16, t uint16) bool {
+	for _, candidate := range types {
+		if candidate == t {
+			return true
+		}
+	}
+	return false
+}
+
+func dedup(types []uint16) []uint16 {
+	out := types[:0]
+	for i, t := range types {
+		if i == 0 || t != types[i-1] {
+			out = append(out, t)
+		}
+	}
+	return out
+}
@@ -0,0 +1,160 @@
+package bottintest
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Hierarchy is a set of Servers listening on real UDP and TCP sockets on the loopback interface.
+// Each Server is reachable at the IP addresses the delegations of the hierarchy advertise, which
+// Exchange maps to the loopback port of its sockets. It implements the Exchanger interface of
+// bottin, and RootHints returns the matching root hints for the resolver.
+type Hierarchy struct {
+	listeners map[string]*listener // By advertised IP address.
+	all       []*listener
+	mutex     sync.RWMutex
+}
+
+// listener holds the sockets of a Server.
+type listener struct {
+	srv  *Server
+	addr string // Loopback host:port, the same for UDP and TCP.
+	udp  *dns.Server
+	tcp  *dns.Server
+}
+
+// NewHierarchy returns an empty Hierarchy. Close it to release its sockets.
+func NewHierarchy() *Hierarchy {
+	return &Hierarchy{
+		listeners: make(map[string]*listener),
+	}
+}
+
+// Start serves srv on loopback sockets, and makes it reachable at each of the IP addresses addrs.
+// The settings of srv must not change once it is started.
+func (h *Hierarchy) Start(srv *Server, addrs ...string) error {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		return err
+	}
+	l, err := net.Listen("tcp", pc.LocalAddr().String())
+	if err != nil {
+		pc.Close()
+		return err
+	}
+
+	ln := &listener{srv: srv, addr: pc.LocalAddr().String()}
+	ln.udp = &dns.Server{PacketConn: pc, Handler: ln.handler("udp")}
+	ln.tcp = &dns.Server{Listener: l, Handler: ln.handler("tcp")}
+	for _, s := range []*dns.Server{ln.udp, ln.tcp} {
+		started := make(chan struct{})
+		s.NotifyStartedFunc = func() { close(started) }
+		errs := make(chan error, 1)
+		go func() { errs <- s.ActivateAndServe() }()
+		select {
+		case <-started:
+		case err := <-errs:
+			ln.shutdown()
+			return err
+		}
+	}
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.all = append(h.all, ln)
+	for _, addr := range addrs {
+		h.listeners[addr] = ln
+	}
+	return nil
+}
+
+// handler answers the queries received over network with srv.
+func (ln *listener) handler(network string) dns.Handler {
+	return dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		if ln.srv.Drop {
+			ln.srv.queries.Add(1)
+			return
+		}
+		if ln.srv.RTT > 0 {
+			time.Sleep(ln.srv.RTT)
+		}
+		w.WriteMsg(ln.srv.Handle(req, network))
+	})
+}
+
+func (ln *listener) shutdown() {
+	ln.udp.Shutdown()
+	ln.tcp.Shutdown()
+}
+
+// Addr returns the loopback host:port of the sockets of the Server reachable at the IP address
+// addr, or "" if there is none.
+func (h *Hierarchy) Addr(addr string) string {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+	if ln := h.listeners[addr]; ln != nil {
+		return ln.addr
+	}
+	return ""
+}
+
+// Exchange sends msg over network to the sockets of the Server reachable at addr (host:port).
+func (h *Hierarchy) Exchange(ctx context.Context, msg *dns.Msg, network, addr string) (*dns.Msg, time.Duration, error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, 0, err
+	}
+	target := h.Addr(host)
+	if target == "" {
+		return nil, 0, &net.OpError{Op: "dial", Net: network, Err: fmt.Errorf("bottintest: no server at %s", addr)}
+	}
+	client := &dns.Client{Net: network}
+	if deadline, ok := ctx.Deadline(); ok {
+		client.Timeout = time.Until(deadline)
+	}
+	return client.ExchangeContext(ctx, msg, target)
+}
+
+// RootHints returns the root hints of the hierarchy in the format of named.root: the NS records
+// of the root zone of the first Server authoritative for it, and the addresses of these
+// nameservers.
+func (h *Hierarchy) RootHints() (string, error) {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+	for _, ln := range h.all {
+		z := ln.srv.zoneFor(".")
+		if z == nil || z.origin != "." {
+			continue
+		}
+		var b strings.Builder
+		for _, rr := range z.rrs(".", dns.TypeNS) {
+			host := strings.ToLower(rr.(*dns.NS).Ns)
+			fmt.Fprintln(&b, rr)
+			for _, rrtype := range []uint16{dns.TypeA, dns.TypeAAAA} {
+				for _, glue := range z.rrs(host, rrtype) {
+					fmt.Fprintln(&b, glue)
+				}
+			}
+		}
+		return b.String(), nil
+	}
+	return "", fmt.Errorf("bottintest: no server for the root zone")
+}
+
+// Close shuts the sockets of every Server of the hierarchy down.
+func (h *Hierarchy) Close() error {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	for _, ln := range h.all {
+		ln.shutdown()
+	}
+	h.all = nil
+	h.listeners = make(map[string]*listener)
+	return nil
+}
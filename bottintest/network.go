@@ -0,0 +1,85 @@
+package bottintest
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Network is an in-memory set of Servers, keyed by IP address. It implements the Exchanger
+// interface of bottin, so that resolutions can run without any socket.
+type Network struct {
+	servers map[string]*Server
+	mutex   sync.RWMutex
+}
+
+// NewNetwork returns an empty Network.
+func NewNetwork() *Network {
+	return &Network{
+		servers: make(map[string]*Server),
+	}
+}
+
+// Add makes srv reachable at each of the IP addresses addrs.
+func (n *Network) Add(srv *Server, addrs ...string) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	for _, addr := range addrs {
+		n.servers[addr] = srv
+	}
+}
+
+// Server returns the Server reachable at the IP address addr, if any.
+func (n *Network) Server(addr string) *Server {
+	n.mutex.RLock()
+	defer n.mutex.RUnlock()
+	return n.servers[addr]
+}
+
+// Exchange sends msg to the Server at addr (host:port). The response goes through a wire round
+// trip, as it would over a socket.
+func (n *Network) Exchange(ctx context.Context, msg *dns.Msg, network, addr string) (*dns.Msg, time.Duration, error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, 0, err
+	}
+	srv := n.Server(host)
+	if srv == nil {
+		return nil, 0, &net.OpError{Op: "dial", Net: network, Err: fmt.Errorf("bottintest: no server at %s", addr)}
+	}
+
+	start := time.Now()
+	if srv.Drop {
+		srv.queries.Add(1)
+		<-ctx.Done()
+		return nil, time.Since(start), timeoutError{}
+	}
+	if srv.RTT > 0 {
+		select {
+		case <-time.After(srv.RTT):
+		case <-ctx.Done():
+			return nil, time.Since(start), timeoutError{}
+		}
+	}
+
+	buf, err := srv.Handle(msg, network).Pack()
+	if err != nil {
+		return nil, 0, err
+	}
+	resp := new(dns.Msg)
+	if err := resp.Unpack(buf); err != nil {
+		return nil, 0, err
+	}
+	return resp, time.Since(start), nil
+}
+
+// timeoutError is the net.Error returned when a query gets no response.
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "bottintest: i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
@@ -0,0 +1,229 @@
+// Package bottintest provides simulated DNS hierarchies to test resolvers without the internet.
+//
+// A Server is authoritative for zones loaded from zone-file text, and answers like a real
+// authoritative nameserver would: with answers, referrals with glue, CNAME and DNAME chains,
+// NODATA and NXDOMAIN responses. Servers can also misbehave, to exercise the error paths.
+//
+// A Network serves Servers in memory, and a Hierarchy serves them on real loopback sockets.
+package bottintest
+
+import (
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Server is a simulated authoritative nameserver.
+type Server struct {
+	Refuse   bool          // Answer REFUSED to every query, like a lame server.
+	Drop     bool          // Never answer, so that queries time out.
+	NoEDNS   bool          // Answer FORMERR to queries with an EDNS0 OPT record.
+	Truncate bool          // Set the TC bit on every UDP response.
+	RTT      time.Duration // Simulated round trip time.
+	Validity time.Duration // Validity period of the signatures made by Sign, 30 days if 0.
+
+	// Mangle alters each response before it is sent, to simulate broken or spoofed servers.
+	Mangle func(resp *dns.Msg)
+
+	zones   []*zone
+	queries atomic.Int64
+}
+
+// zone holds the records of a zone, by lowercase owner name.
+type zone struct {
+	origin  string
+	records map[string][]dns.RR
+	signed  bool // Signed with Server.Sign.
+}
+
+// NewServer returns a Server authoritative for zones, given as zone-file text. The origin of
+// each zone is the owner of its SOA record.
+func NewServer(zones ...string) (*Server, error) {
+	srv := new(Server)
+	for _, text := range zones {
+		z, err := parseZone(text)
+		if err != nil {
+			return nil, err
+		}
+		srv.zones = append(srv.zones, z)
+	}
+	return srv, nil
+}
+
+func parseZone(text string) (*zone, error) {
+	z := &zone{records: make(map[string][]dns.RR)}
+	zp := dns.NewZoneParser(strings.NewReader(text), "", "")
+	for rr, ok := zp.Next(); ok; rr, ok = zp.Next() {
+		name := strings.ToLower(rr.Header().Name)
+		rr.Header().Name = name
+		if _, isSOA := rr.(*dns.SOA); isSOA {
+			z.origin = name
+		}
+		z.records[name] = append(z.records[name], rr)
+	}
+	if err := zp.Err(); err != nil {
+		return nil, err
+	}
+	if z.origin == "" {
+		return nil, fmt.Errorf("bottintest: zone without SOA record")
+	}
+	return z, nil
+}
+
+// Queries returns the number of queries the server received.
+func (s *Server) Queries() int {
+	return int(s.queries.Load())
+}
+
+// Handle returns the response of the server to req, received over network ("udp" or "tcp").
+// Drop is not applied, the caller decides how not to answer.
+func (s *Server) Handle(req *dns.Msg, network string) *dns.Msg {
+	s.queries.Add(1)
+	resp := s.handle(req, network)
+	if s.Mangle != nil {
+		s.Mangle(resp)
+	}
+	return resp
+}
+
+func (s *Server) handle(req *dns.Msg, network string) *dns.Msg {
+	resp := new(dns.Msg)
+	resp.SetReply(req)
+	opt := req.IsEdns0()
+
+	switch {
+	case len(req.Question) != 1 || (opt != nil && s.NoEDNS):
+		resp.Rcode = dns.RcodeFormatError
+		return resp
+	case s.Refuse:
+		resp.Rcode = dns.RcodeRefused
+		return resp
+	}
+
+	q := req.Question[0]
+	qname := strings.ToLower(q.Name)
+	do := opt != nil && opt.Do()
+	zoneName := qname
+	if q.Qtype == dns.TypeDS && qname != "." {
+		zoneName, _ = parentName(qname) // DS records belong to the parent zone.
+	}
+	if z := s.zoneFor(zoneName); z != nil {
+		z.answer(resp, qname, q.Qtype, do && z.signed)
+	} else {
+		resp.Rcode = dns.RcodeRefused
+	}
+
+	size := dns.MinMsgSize
+	if opt != nil {
+		resp.SetEdns0(opt.UDPSize(), do)
+		if int(opt.UDPSize()) > size {
+			size = int(opt.UDPSize())
+		}
+	}
+	if network != "tcp" {
+		resp.Truncate(size)
+		if s.Truncate {
+			resp.Truncated = true
+		}
+	}
+	return resp
+}
+
+// zoneFor returns the deepest zone of the server containing qname.
+func (s *Server) zoneFor(qname string) *zone {
+	var best *zone
+	for _, z := range s.zones {
+		if dns.IsSubDomain(z.origin, qname) && (best == nil || dns.CountLabel(z.origin) > dns.CountLabel(best.origin)) {
+			best = z
+		}
+	}
+	return best
+}
+
+// answer fills resp with the answer of the zone to qname/qtype, with the DNSSEC records if dnssec
+// is set.
+func (z *zone) answer(resp *dns.Msg, qname string, qtype uint16, dnssec bool) {
+	if dnssec {
+		defer z.sign(resp)
+	}
+	// Walk down from the apex to find delegations and DNAMEs on the way to qname.
+	labels := dns.SplitDomainName(qname)
+	for i := len(labels) - dns.CountLabel(z.origin) - 1; i >= 0; i-- {
+		name := dns.Fqdn(strings.Join(labels[i:], "."))
+		if ns := z.rrs(name, dns.TypeNS); len(ns) > 0 && !(name == qname && qtype == dns.TypeDS) {
+			resp.Ns = ns
+			for _, rr := range ns {
+				target := strings.ToLower(rr.(*dns.NS).Ns)
+				resp.Extra = append(resp.Extra, z.rrs(target, dns.TypeA)...)
+				resp.Extra = append(resp.Extra, z.rrs(target, dns.TypeAAAA)...)
+			}
+			if dnssec {
+				// The DS records of the delegation, or the proof that there are none.
+				if ds := z.rrs(name, dns.TypeDS); len(ds) > 0 {
+					resp.Ns = append(resp.Ns, ds...)
+				} else {
+					z.deny(resp, name, false)
+				}
+			}
+			return
+		}
+		if dnames := z.rrs(name, dns.TypeDNAME); len(dnames) > 0 && name != qname {
+			dname := dnames[0].(*dns.DNAME)
+			resp.Authoritative = true
+			resp.Answer = append(resp.Answer, dname, &dns.CNAME{
+				Hdr:    dns.RR_Header{Name: qname, Rrtype: dns.TypeCNAME, Class: dns.ClassINET, Ttl: dname.Hdr.Ttl},
+				Target: strings.TrimSuffix(qname, name) + strings.ToLower(dname.Target),
+			})
+			return
+		}
+	}
+
+	resp.Authoritative = true
+	name := qname
+	for hops := 0; hops < 8; hops++ {
+		if rrs := z.rrs(name, qtype); len(rrs) > 0 {
+			resp.Answer = append(resp.Answer, rrs...)
+			return
+		}
+		cnames := z.rrs(name, dns.TypeCNAME)
+		if len(cnames) == 0 || qtype == dns.TypeCNAME {
+			break
+		}
+		resp.Answer = append(resp.Answer, cnames...)
+		name = strings.ToLower(cnames[0].(*dns.CNAME).Target)
+		if !dns.IsSubDomain(z.origin, name) {
+			return // The resolver follows the chain out of the zone.
+		}
+	}
+	if !z.exists(name) {
+		resp.Rcode = dns.RcodeNameError
+	}
+	resp.Ns = z.rrs(z.origin, dns.TypeSOA)
+	if dnssec {
+		z.deny(resp, name, resp.Rcode == dns.RcodeNameError)
+	}
+}
+
+// rrs returns copies of the records of the zone with the given owner and type.
+func (z *zone) rrs(name string, rrtype uint16) []dns.RR {
+	var rrs []dns.RR
+	for _, rr := range z.records[name] {
+		if rr.Header().Rrtype == rrtype {
+			rrs = append(rrs, dns.Copy(rr))
+		}
+	}
+	return rrs
+}
+
+// exists reports whether name owns records in the zone, or is an empty non-terminal.
+func (z *zone) exists(name string) bool {
+	for owner := range z.records {
+		if dns.IsSubDomain(name, owner) {
+			return true
+		}
+	}
+	return false
+}
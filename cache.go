@@ -1,89 +1,477 @@
 package bottin
 
 import (
+	"container/list"
 	"encoding/json"
 	"sync"
 	"time"
 )
 
 // Cache stores slices of RR structs, with each key mapping to an RR slice.
+// When a capacity is set, the least recently used keys are evicted to stay within it.
 type Cache struct {
-	items map[string][]RR
-	mutex sync.RWMutex
+	items    map[string]*list.Element
+	lru      *list.List    // Most recently used entries at the front.
+	capacity int           // Maximum number of keys, 0 for unbounded.
+	stale    time.Duration // How long records are kept once expired, for GetStale.
+	ttls     ttlPolicy
+	prefetch prefetcher
+	interval time.Duration // Interval of the cleanup of expired records.
+	clock    Clock
+	stats    CacheStats
+	mutex    sync.RWMutex
+
+	closed  bool
+	done    chan struct{}  // Closed by Close to stop the janitor.
+	workers sync.WaitGroup // The janitor and the prefetch goroutines.
+}
+
+// CacheStats holds the counters of a Cache.
+type CacheStats struct {
+	Hits      uint64 `json:"hits"`
+	Misses    uint64 `json:"misses"`
+	Evictions uint64 `json:"evictions"`
+	Stale     uint64 `json:"stale"` // Lookups answered with expired records by GetStale.
+}
+
+// CacheOption specifies a configuration option for a Cache.
+type CacheOption func(*Cache)
+
+// entry is the value of the LRU list elements.
+type entry struct {
+	key         string
+	rrs         []RR
+	hits        int            // Number of Get hits since the entry was set.
+	prefetching bool           // The refresh of the entry was requested.
+	pinned      bool           // The entry never expires nor is evicted.
+	rank        Rank           // Credibility of the records.
+	security    SecurityStatus // DNSSEC status of the records.
+}
+
+// Rank is the credibility of cached records, according to where they were found in a response
+// (RFC 2181 section 5.4.1). Records of a higher rank are more trustworthy.
+type Rank uint8
+
+// Ranks of cached records, from the least to the most trustworthy.
+const (
+	RankAdditional Rank = iota + 1 // Additional section, like glue.
+	RankAuthority                  // Authority section, like the NS records of a referral.
+	RankAnswer                     // Answer section of a non-authoritative response.
+	RankAuthAnswer                 // Answer section of an authoritative response.
+)
+
+// ttlPolicy holds the bounds applied to the TTL of the records stored in a Cache.
+type ttlPolicy struct {
+	min         time.Duration // Floor of the TTLs.
+	max         time.Duration // Cap of the TTLs of positive entries, 0 for none.
+	negativeMax time.Duration // Cap of the TTLs of negative entries, 0 for none.
+	noExpiry    bool          // Records stored with Set don't expire.
+}
+
+// prefetcher holds the prefetch settings of a Cache.
+type prefetcher struct {
+	fraction float64          // Fraction of the TTL left under which entries are refreshed.
+	minHits  int              // Number of hits an entry needs to be refreshed.
+	refresh  func(key string) // Refreshes the entry of key, nil to disable prefetch.
+}
+
+// WithCapacity bounds the cache to cap keys, 0 meaning unbounded.
+func WithCapacity(cap int) CacheOption {
+	return func(c *Cache) {
+		c.capacity = cap
+	}
+}
+
+// WithMinTTL raises the TTL of the records stored in the cache to at least ttl.
+func WithMinTTL(ttl time.Duration) CacheOption {
+	return func(c *Cache) {
+		c.ttls.min = ttl
+	}
+}
+
+// WithMaxTTL caps the TTL of the records stored with Set to ttl, like Unbound's cache-max-ttl.
+func WithMaxTTL(ttl time.Duration) CacheOption {
+	return func(c *Cache) {
+		c.ttls.max = ttl
+	}
+}
+
+// WithNegativeMaxTTL caps the TTL of the negative entries stored with SetNegative to ttl, like
+// Unbound's cache-max-negative-ttl.
+func WithNegativeMaxTTL(ttl time.Duration) CacheOption {
+	return func(c *Cache) {
+		c.ttls.negativeMax = ttl
+	}
+}
+
+// WithoutExpiry ignores the TTL of the records stored with Set: they stay in the cache until they
+// are evicted or deleted. Negative entries stored with SetNegative still expire.
+func WithoutExpiry() CacheOption {
+	return func(c *Cache) {
+		c.ttls.noExpiry = true
+	}
+}
+
+// WithStaleWindow keeps expired records for window after their expiry, so that GetStale can
+// still return them (RFC 8767).
+func WithStaleWindow(window time.Duration) CacheOption {
+	return func(c *Cache) {
+		c.stale = window
+	}
+}
+
+// WithPrefetchFunc calls refresh in a new goroutine when Get hits an entry having less than
+// fraction of its TTL left, if the entry was hit at least minHits times. refresh is called once
+// per entry, until the entry is set again.
+func WithPrefetchFunc(fraction float64, minHits int, refresh func(key string)) CacheOption {
+	return func(c *Cache) {
+		c.prefetch = prefetcher{fraction: fraction, minHits: minHits, refresh: refresh}
+	}
+}
+
+// WithCleanupInterval sets the interval at which the expired records are removed, a minute by
+// default. An interval of 0 disables the cleanup.
+func WithCleanupInterval(interval time.Duration) CacheOption {
+	return func(c *Cache) {
+		c.interval = interval
+	}
+}
+
+// WithCacheClock makes the cache tell the time with clock, instead of the system clock.
+func WithCacheClock(clock Clock) CacheOption {
+	return func(c *Cache) {
+		c.clock = clock
+	}
 }
 
 // NewCache initializes a new cache for storing slices of RR structs.
-func NewCache() *Cache {
+// Close it to stop its background cleanup.
+func NewCache(options ...CacheOption) *Cache {
 	cache := &Cache{
-		items: make(map[string][]RR),
+		items:    make(map[string]*list.Element),
+		lru:      list.New(),
+		interval: time.Minute,
+		clock:    systemClock{},
+		done:     make(chan struct{}),
+	}
+	for _, option := range options {
+		option(cache)
+	}
+	if cache.interval > 0 {
+		cache.workers.Add(1)
+		go cache.cleanup() // Start cleanup routine to remove expired items.
 	}
-	go cache.cleanup() // Start cleanup routine to remove expired items.
 	return cache
 }
 
-// Set adds a slice of RR items to the cache for a specific key. Each RR's Expiry is set based on its TTL.
+// Close stops the background cleanup of the cache, and waits for the prefetch goroutines it
+// started to return. The cache can still be used, without cleanup nor prefetch.
+func (c *Cache) Close() error {
+	c.mutex.Lock()
+	if c.closed {
+		c.mutex.Unlock()
+		return nil
+	}
+	c.closed = true
+	close(c.done)
+	c.mutex.Unlock()
+	c.workers.Wait()
+	return nil
+}
+
+// Set adds a slice of RR items to the cache for a specific key. Each RR's Expiry is set based on
+// its TTL, once bounded by the TTL policy of the cache. Records with a TTL of 0 are not cached, as
+// in DNS, and an entry without records left is deleted.
+// Set stores the records unconditionally, with the rank of an authoritative answer.
 func (c *Cache) Set(key string, rrs []RR) {
-	now := time.Now()
-	for i := range rrs {
-		if rrs[i].TTL == 0 {
-			rrs[i].TTL = time.Second * 86400 * 365 * 100
-			rrs[i].Expiry = now.Add(time.Second * 86400 * 365 * 100)
-		} else {
-			rrs[i].Expiry = now.Add(rrs[i].TTL)
+	c.store(key, rrs, c.ttls.max, c.ttls.noExpiry, RankAuthAnswer, Indeterminate, true)
+}
+
+// SetRanked is like Set, for records of the given rank. The records aren't stored, and false is
+// returned, if the entry of key holds unexpired records of a higher rank, or is pinned.
+func (c *Cache) SetRanked(key string, rrs []RR, rank Rank) bool {
+	return c.store(key, rrs, c.ttls.max, c.ttls.noExpiry, rank, Indeterminate, false)
+}
+
+// SetValidated is like SetRanked, for records of the given DNSSEC status, returned by Security.
+func (c *Cache) SetValidated(key string, rrs []RR, rank Rank, status SecurityStatus) bool {
+	return c.store(key, rrs, c.ttls.max, c.ttls.noExpiry, rank, status, false)
+}
+
+// SetNegative adds the records of a negative entry, like the SOA record of an NXDOMAIN response,
+// to the cache for a specific key. It is like Set, with the TTL cap of negative entries.
+func (c *Cache) SetNegative(key string, rrs []RR) {
+	c.store(key, rrs, c.ttls.negativeMax, false, RankAuthAnswer, Indeterminate, true)
+}
+
+// SetNegativeValidated is like SetNegative, for a negative entry of the given DNSSEC status.
+func (c *Cache) SetNegativeValidated(key string, rrs []RR, status SecurityStatus) {
+	c.store(key, rrs, c.ttls.negativeMax, false, RankAuthAnswer, status, true)
+}
+
+// SetPinned adds a slice of RR items to the cache for a specific key, ignoring their TTL: the
+// entry never expires and is never evicted, like root hints or static entries. It stays until it
+// is deleted or set again.
+func (c *Cache) SetPinned(key string, rrs []RR) {
+	pinned := make([]RR, len(rrs))
+	for i, rr := range rrs {
+		rr.Expiry = time.Time{}
+		pinned[i] = rr
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.set(key, pinned).pinned = true
+}
+
+// store sets the entry of key to rrs of the given rank and DNSSEC status, with their TTLs bounded
+// by the minimum TTL and max, 0 for no cap. Unless noExpiry is set, records with a TTL of 0 are dropped. Unless force is
+// set, an entry of a higher rank, or pinned, is kept, and false returned.
+func (c *Cache) store(key string, rrs []RR, max time.Duration, noExpiry bool, rank Rank, status SecurityStatus, force bool) bool {
+	now := c.clock.Now()
+	var stored []RR
+	for _, rr := range rrs {
+		if rr.TTL < c.ttls.min {
+			rr.TTL = c.ttls.min
+		}
+		if max > 0 && rr.TTL > max {
+			rr.TTL = max
+		}
+		switch {
+		case noExpiry:
+			rr.Expiry = time.Time{}
+		case rr.TTL <= 0:
+			continue // TTL 0: use the record once, don't cache it.
+		default:
+			rr.Expiry = now.Add(rr.TTL)
 		}
+		stored = append(stored, rr)
 	}
 	c.mutex.Lock()
 	defer c.mutex.Unlock()
-	c.items[key] = rrs
+	elem, found := c.items[key]
+	if found && !force && c.outranks(elem.Value.(*entry), rank, now) {
+		return false
+	}
+	if len(stored) == 0 {
+		if found {
+			c.remove(elem)
+		}
+		return true
+	}
+	e := c.set(key, stored)
+	e.rank = rank
+	e.security = status
+	return true
+}
+
+// outranks reports whether e must be kept rather than replaced by records of the given rank.
+func (c *Cache) outranks(e *entry, rank Rank, now time.Time) bool {
+	if e.pinned {
+		return true
+	}
+	if e.rank <= rank {
+		return false
+	}
+	for _, rr := range e.rrs {
+		if !expired(rr, now) {
+			return true
+		}
+	}
+	return false
+}
+
+// expired reports whether rr is expired at now. Records with a zero Expiry never expire.
+func expired(rr RR, now time.Time) bool {
+	return !rr.Expiry.IsZero() && !now.Before(rr.Expiry)
+}
+
+// staleExpired reports whether rr is expired at now for more than the stale window.
+func (c *Cache) staleExpired(rr RR, now time.Time) bool {
+	return !rr.Expiry.IsZero() && !now.Before(rr.Expiry.Add(c.stale))
+}
+
+// set stores rrs under key as the most recently used entry, evicting the least recently used
+// unpinned ones beyond capacity, and returns the entry. The caller must hold the write lock.
+func (c *Cache) set(key string, rrs []RR) *entry {
+	if elem, found := c.items[key]; found {
+		e := elem.Value.(*entry)
+		*e = entry{key: key, rrs: rrs}
+		c.lru.MoveToFront(elem)
+		return e
+	}
+	e := &entry{key: key, rrs: rrs}
+	c.items[key] = c.lru.PushFront(e)
+	for elem := c.lru.Back(); c.capacity > 0 && c.lru.Len() > c.capacity && elem != nil; {
+		prev := elem.Prev()
+		if victim := elem.Value.(*entry); !victim.pinned && victim != e {
+			c.remove(elem)
+			c.stats.Evictions++
+		}
+		elem = prev
+	}
+	return e
+}
+
+// remove drops elem from the cache. The caller must hold the write lock.
+func (c *Cache) remove(elem *list.Element) {
+	c.lru.Remove(elem)
+	delete(c.items, elem.Value.(*entry).key)
 }
 
 // Get retrieves a slice of RR items by key if they exist and are unexpired.
 func (c *Cache) Get(key string) ([]RR, bool) {
-	c.mutex.RLock()
-	defer c.mutex.RUnlock()
-	items, found := c.items[key]
+	// The write lock is needed to update the recency of the entry.
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	elem, found := c.items[key]
 	if !found {
+		c.stats.Misses++
 		return nil, false
 	}
 	// Filter out expired records.
+	now := c.clock.Now()
+	e := elem.Value.(*entry)
 	validItems := []RR{}
-	for _, item := range items {
-		if time.Now().Before(item.Expiry) {
+	for _, item := range e.rrs {
+		if !expired(item, now) {
 			validItems = append(validItems, item)
 		}
 	}
 	if len(validItems) == 0 {
+		c.stats.Misses++
 		return nil, false
 	}
+	c.lru.MoveToFront(elem)
+	c.stats.Hits++
+	e.hits++
+	if c.shouldPrefetch(e, validItems, now) {
+		e.prefetching = true
+		c.workers.Add(1)
+		go func() {
+			defer c.workers.Done()
+			c.prefetch.refresh(key)
+		}()
+	}
 	return validItems, true
 }
 
+// shouldPrefetch reports whether the entry e, whose unexpired records are rrs, must be refreshed.
+func (c *Cache) shouldPrefetch(e *entry, rrs []RR, now time.Time) bool {
+	if c.prefetch.refresh == nil || c.closed || e.prefetching || e.hits < c.prefetch.minHits {
+		return false
+	}
+	for _, rr := range rrs {
+		if rr.TTL > 0 && !rr.Expiry.IsZero() && float64(rr.Expiry.Sub(now)) < c.prefetch.fraction*float64(rr.TTL) {
+			return true
+		}
+	}
+	return false
+}
+
+// GetStale retrieves a slice of RR items by key, including the records expired for less than the
+// stale window. Unlike Get, it doesn't count hits and misses, as it is meant to be used after a
+// failed Get.
+func (c *Cache) GetStale(key string) ([]RR, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	elem, found := c.items[key]
+	if !found {
+		return nil, false
+	}
+	now := c.clock.Now()
+	var items []RR
+	stale := false
+	for _, item := range elem.Value.(*entry).rrs {
+		if !c.staleExpired(item, now) {
+			items = append(items, item)
+			stale = stale || expired(item, now)
+		}
+	}
+	if len(items) == 0 {
+		return nil, false
+	}
+	if stale {
+		c.stats.Stale++
+	}
+	return items, true
+}
+
+// Security returns the DNSSEC status of the records of key, Indeterminate if they weren't validated
+// or aren't in the cache.
+func (c *Cache) Security(key string) SecurityStatus {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	if elem, found := c.items[key]; found {
+		return elem.Value.(*entry).security
+	}
+	return Indeterminate
+}
+
+// Rank returns the rank of the records of key, 0 if they aren't in the cache.
+func (c *Cache) Rank(key string) Rank {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	if elem, found := c.items[key]; found {
+		return elem.Value.(*entry).rank
+	}
+	return 0
+}
+
 // Delete removes an item from the cache by key.
 func (c *Cache) Delete(key string) {
 	c.mutex.Lock()
 	defer c.mutex.Unlock()
-	delete(c.items, key)
+	if elem, found := c.items[key]; found {
+		c.remove(elem)
+	}
+}
+
+// Len returns the number of keys in the cache.
+func (c *Cache) Len() int {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	return c.lru.Len()
 }
 
-// cleanup removes expired items periodically.
+// Stats returns a snapshot of the cache counters.
+func (c *Cache) Stats() CacheStats {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	return c.stats
+}
+
+// cleanup removes expired items periodically until the cache is closed.
 func (c *Cache) cleanup() {
+	defer c.workers.Done()
 	for {
-		time.Sleep(time.Minute) // Cleanup interval.
-		c.mutex.Lock()
-		for key, items := range c.items {
-			validItems := []RR{}
-			for _, item := range items {
-				if time.Now().Before(item.Expiry) {
-					validItems = append(validItems, item)
-				}
-			}
-			if len(validItems) > 0 {
-				c.items[key] = validItems
-			} else {
-				delete(c.items, key)
+		select {
+		case now := <-c.clock.After(c.interval):
+			c.removeExpired(now)
+		case <-c.done:
+			return
+		}
+	}
+}
+
+// removeExpired removes the records expired at now for longer than the stale window.
+func (c *Cache) removeExpired(now time.Time) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for elem := c.lru.Front(); elem != nil; {
+		next := elem.Next()
+		e := elem.Value.(*entry)
+		validItems := []RR{}
+		for _, item := range e.rrs {
+			if !c.staleExpired(item, now) {
+				validItems = append(validItems, item)
 			}
 		}
-		c.mutex.Unlock()
+		if len(validItems) > 0 {
+			e.rrs = validItems
+		} else {
+			c.remove(elem)
+		}
+		elem = next
 	}
 }
 
@@ -91,7 +479,11 @@ func (c *Cache) cleanup() {
 func (c *Cache) DumpJSON() (string, error) {
 	c.mutex.RLock()
 	defer c.mutex.RUnlock()
-	data, err := json.Marshal(c.items)
+	items := make(map[string][]RR, len(c.items))
+	for key, elem := range c.items {
+		items[key] = elem.Value.(*entry).rrs
+	}
+	data, err := json.Marshal(items)
 	if err != nil {
 		return "", err
 	}
@@ -106,11 +498,14 @@ func (c *Cache) LoadJSON(data string) error {
 	}
 
 	// Restore the items and adjust Expiry based on current time.
-	now := time.Now()
+	now := c.clock.Now()
 	c.mutex.Lock()
 	defer c.mutex.Unlock()
 	for key, rrs := range items {
 		for i := range rrs {
+			if rrs[i].Expiry.IsZero() {
+				continue // The record doesn't expire.
+			}
 			// Recompute Expiry based on how much TTL remains.
 			timeRemaining := rrs[i].Expiry.Sub(now)
 			if timeRemaining > 0 {
@@ -119,7 +514,7 @@ func (c *Cache) LoadJSON(data string) error {
 				rrs[i].Expiry = now // Expired items get an immediate expiry.
 			}
 		}
-		c.items[key] = rrs
+		c.set(key, rrs)
 	}
 	return nil
 }
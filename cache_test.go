@@ -0,0 +1,201 @@
+package bottin
+
+import (
+	"fmt"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/kakwa/bottin/bottintest"
+	"github.com/nbio/st"
+)
+
+func testRRs(name string) []RR {
+	return []RR{{Name: name, Type: "A", Value: "192.0.2.1", TTL: time.Hour}}
+}
+
+func TestCacheLRUEviction(t *testing.T) {
+	c := NewCache(WithCapacity(2))
+	c.Set("a.|A", testRRs("a."))
+	c.Set("b.|A", testRRs("b."))
+	_, ok := c.Get("a.|A") // a. is now more recently used than b.
+	st.Expect(t, ok, true)
+	c.Set("c.|A", testRRs("c."))
+
+	st.Expect(t, c.Len(), 2)
+	_, ok = c.Get("b.|A")
+	st.Expect(t, ok, false)
+	_, ok = c.Get("a.|A")
+	st.Expect(t, ok, true)
+	_, ok = c.Get("c.|A")
+	st.Expect(t, ok, true)
+	st.Expect(t, c.Stats(), CacheStats{Hits: 3, Misses: 1, Evictions: 1})
+}
+
+func TestCacheUpdateDoesNotEvict(t *testing.T) {
+	c := NewCache(WithCapacity(2))
+	c.Set("a.|A", testRRs("a."))
+	c.Set("b.|A", testRRs("b."))
+	c.Set("a.|A", testRRs("a."))
+	st.Expect(t, c.Len(), 2)
+	st.Expect(t, c.Stats().Evictions, uint64(0))
+}
+
+func TestCacheUnbounded(t *testing.T) {
+	c := NewCache()
+	for i := 0; i < 100; i++ {
+		name := fmt.Sprintf("%d.com.", i)
+		c.Set(name+"|A", testRRs(name))
+	}
+	st.Expect(t, c.Len(), 100)
+	st.Expect(t, c.Stats().Evictions, uint64(0))
+}
+
+func TestCacheConcurrent(t *testing.T) {
+	c := NewCache(WithCapacity(10))
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				name := fmt.Sprintf("%d-%d.com.", i, j)
+				c.Set(name+"|A", testRRs(name))
+				c.Get(name + "|A")
+			}
+		}(i)
+	}
+	wg.Wait()
+	st.Expect(t, c.Len(), 10)
+	st.Expect(t, c.Stats().Evictions, uint64(790))
+}
+
+func TestCacheGetStale(t *testing.T) {
+	clock := bottintest.NewClock(time.Now())
+	c := NewCache(WithStaleWindow(time.Hour), WithCacheClock(clock))
+	c.Set("a.|A", []RR{{Name: "a.", Type: "A", Value: "192.0.2.1", TTL: time.Minute}})
+	clock.Advance(time.Minute)
+	_, ok := c.Get("a.|A")
+	st.Expect(t, ok, false)
+	rrs, ok := c.GetStale("a.|A")
+	st.Expect(t, ok, true)
+	st.Expect(t, rrs[0].Value, "192.0.2.1")
+	st.Expect(t, c.Stats(), CacheStats{Misses: 1, Stale: 1})
+
+	clock.Advance(time.Hour)
+	_, ok = c.GetStale("a.|A")
+	st.Expect(t, ok, false)
+}
+
+func TestCachePrefetch(t *testing.T) {
+	clock := bottintest.NewClock(time.Now())
+	refreshed := make(chan string, 10)
+	c := NewCache(WithCacheClock(clock), WithPrefetchFunc(0.5, 2, func(key string) { refreshed <- key }))
+	defer c.Close()
+	c.Set("a.|A", []RR{{Name: "a.", Type: "A", Value: "192.0.2.1", TTL: time.Minute}})
+	c.Get("a.|A")
+	c.Get("a.|A")
+	st.Expect(t, len(refreshed), 0) // Hot, but still fresh.
+	clock.Advance(40 * time.Second)
+	c.Get("a.|A") // Hot, but refreshed once only.
+	c.Get("a.|A")
+	st.Expect(t, <-refreshed, "a.|A")
+
+	c.Set("b.|A", []RR{{Name: "b.", Type: "A", Value: "192.0.2.2", TTL: time.Minute}})
+	clock.Advance(40 * time.Second)
+	c.Get("b.|A") // Not hit often enough.
+	c.Close()     // Waits for the refresh goroutines.
+	st.Expect(t, len(refreshed), 0)
+}
+
+func TestCacheZeroTTL(t *testing.T) {
+	c := NewCache()
+	c.Set("a.|A", []RR{{Name: "a.", Type: "A", Value: "192.0.2.1"}})
+	_, ok := c.Get("a.|A")
+	st.Expect(t, ok, false)
+	st.Expect(t, c.Len(), 0)
+
+	// A TTL of 0 replaces the entry, rather than keeping outdated records.
+	c.Set("b.|A", testRRs("b."))
+	c.Set("b.|A", []RR{{Name: "b.", Type: "A", Value: "192.0.2.2"}})
+	_, ok = c.Get("b.|A")
+	st.Expect(t, ok, false)
+}
+
+func TestCacheTTLBounds(t *testing.T) {
+	c := NewCache(WithMinTTL(time.Minute), WithMaxTTL(time.Hour), WithNegativeMaxTTL(5*time.Minute))
+	c.Set("a.|A", []RR{{Name: "a.", Type: "A", Value: "192.0.2.1", TTL: time.Second}})
+	c.Set("b.|A", []RR{{Name: "b.", Type: "A", Value: "192.0.2.2", TTL: 48 * time.Hour}})
+	c.Set("c.|A", []RR{{Name: "c.", Type: "A", Value: "192.0.2.3"}})
+	c.SetNegative("d.|NXDOMAIN", []RR{{Name: "d.", Type: "SOA", Value: "ns.d.", TTL: time.Hour}})
+
+	for key, ttl := range map[string]time.Duration{
+		"a.|A":        time.Minute,
+		"b.|A":        time.Hour,
+		"c.|A":        time.Minute,
+		"d.|NXDOMAIN": 5 * time.Minute,
+	} {
+		rrs, ok := c.Get(key)
+		st.Expect(t, ok, true)
+		st.Expect(t, rrs[0].TTL, ttl)
+		st.Expect(t, rrs[0].Expiry.After(time.Now().Add(ttl-time.Second)), true)
+	}
+}
+
+func TestCachePinned(t *testing.T) {
+	c := NewCache(WithCapacity(2))
+	c.SetPinned(".|NS", []RR{{Name: ".", Type: "NS", Value: "a.root-servers.net."}})
+	c.Set("a.|A", testRRs("a."))
+	c.Set("b.|A", testRRs("b."))
+	c.Set("c.|A", testRRs("c."))
+
+	rrs, ok := c.Get(".|NS")
+	st.Expect(t, ok, true)
+	st.Expect(t, rrs[0].Expiry.IsZero(), true)
+	_, ok = c.Get("c.|A")
+	st.Expect(t, ok, true)
+	st.Expect(t, c.Len(), 2)
+}
+
+func TestCacheWithoutExpiry(t *testing.T) {
+	c := NewCache(WithoutExpiry())
+	c.Set("a.|A", []RR{{Name: "a.", Type: "A", Value: "192.0.2.1"}})
+	c.SetNegative("b.|NXDOMAIN", []RR{{Name: "b.", Type: "SOA", Value: "ns.b."}})
+	_, ok := c.Get("a.|A")
+	st.Expect(t, ok, true)
+	_, ok = c.Get("b.|NXDOMAIN")
+	st.Expect(t, ok, false)
+}
+
+func TestCacheCleanupInterval(t *testing.T) {
+	clock := bottintest.NewClock(time.Now())
+	c := NewCache(WithCleanupInterval(time.Minute), WithStaleWindow(time.Minute), WithCacheClock(clock))
+	defer c.Close()
+	c.Set("a.|A", []RR{{Name: "a.", Type: "A", Value: "192.0.2.1", TTL: time.Minute}})
+	c.Set("b.|A", testRRs("b."))
+
+	for clock.Waiters() == 0 {
+		time.Sleep(time.Millisecond) // Until the janitor waits for the next cleanup.
+	}
+	clock.Advance(time.Minute)
+	st.Expect(t, c.Len(), 2) // a. is expired, but within the stale window.
+	for clock.Waiters() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	clock.Advance(time.Minute)
+	for clock.Waiters() == 0 {
+		time.Sleep(time.Millisecond) // Until the cleanup is done.
+	}
+	st.Expect(t, c.Len(), 1)
+}
+
+func TestCacheClose(t *testing.T) {
+	before := runtime.NumGoroutine()
+	for i := 0; i < 100; i++ {
+		c := NewCache()
+		st.Expect(t, c.Close(), nil)
+		st.Expect(t, c.Close(), nil)
+	}
+	st.Expect(t, runtime.NumGoroutine() <= before, true)
+}
@@ -0,0 +1,16 @@
+package bottin
+
+import "time"
+
+// Clock tells the time to a Cache or a BottinResolver, for the expiry of the records they hold.
+// Network timeouts always use the system clock.
+type Clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+}
+
+// systemClock is the Clock of the time package.
+type systemClock struct{}
+
+func (systemClock) Now() time.Time                         { return time.Now() }
+func (systemClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
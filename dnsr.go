@@ -14,6 +14,7 @@ Original source: https://github.com/domainr/dnsr
 import (
 	"fmt"
 	"io"
+	"log/slog"
 	"net"
 	"time"
 )
@@ -22,8 +23,39 @@ var (
 	Timeout             = 2000 * time.Millisecond
 	TypicalResponseTime = 100 * time.Millisecond
 	MaxRecursion        = 10
+	MaxCNAMEs           = 8
 	MaxNameservers      = 2
 	MaxIPs              = 2
+
+	// HappyEyeballsDelay is the head start given to a nameserver address before the next one is
+	// queried in parallel with the HappyEyeballs policy (RFC 8305 connection attempt delay).
+	HappyEyeballsDelay = 250 * time.Millisecond
+
+	// StaleTTL is the TTL of the expired records served with WithServeStale (RFC 8767).
+	StaleTTL = 30 * time.Second
+
+	// StaleRecheck is how long stale records are served without trying to refresh them after a
+	// refresh failed, the failure recheck timer of RFC 8767.
+	StaleRecheck = 30 * time.Second
+
+	// MinimizeQType is the query type of the minimised queries sent with WithQNameMinimization.
+	// RFC 9156 recommends A over NS, which some nameservers mishandle for the names they delegate.
+	MinimizeQType = "A"
+
+	// AddHoldDown is how long a new key-signing key of a zone with a trust anchor must be published
+	// before it is trusted with WithTrustAnchorFile (RFC 5011 section 2.4.1).
+	AddHoldDown = 30 * 24 * time.Hour
+
+	// RemoveHoldDown is how long a revoked key is remembered with WithTrustAnchorFile before it is
+	// forgotten (RFC 5011 section 2.4.1).
+	RemoveHoldDown = 30 * 24 * time.Hour
+
+	// MaxNSEC3Iterations is the most additional hash iterations of the NSEC3 records of a validated
+	// denial of existence. Beyond it, the denial is Insecure (RFC 9276 section 3.2).
+	MaxNSEC3Iterations = 50
+
+	// EDNSBufferSize is the EDNS0 UDP buffer size advertised by default (DNS Flag Day 2020).
+	EDNSBufferSize uint16 = 1232
 )
 
 // Resolver errors.
@@ -31,44 +63,207 @@ var (
 	NXDOMAIN = fmt.Errorf("NXDOMAIN")
 
 	ErrMaxRecursion = fmt.Errorf("maximum recursion depth reached: %d", MaxRecursion)
+	ErrMaxCNAMEs    = fmt.Errorf("maximum CNAME chain length reached: %d", MaxCNAMEs)
 	ErrMaxIPs       = fmt.Errorf("maximum name server IPs queried: %d", MaxIPs)
 	ErrNoARecords   = fmt.Errorf("no A records found for name server")
 	ErrNoResponse   = fmt.Errorf("no responses received")
+	ErrBadResponse  = fmt.Errorf("response doesn't match the query")
+	ErrClosed       = fmt.Errorf("resolver closed")
 	ErrTimeout      = fmt.Errorf("timeout expired") // TODO: Timeouter interface? e.g. func (e) Timeout() bool { return true }
 )
 
 // Option specifies a configuration option for a Resolver.
-type Option func(*Resolver)
+type Option func(*BottinResolver)
 
 // DebugLogger will receive writes of DNS resolution traces if not nil.
+// It is read when a resolver is created, see also WithTraceWriter.
 var DebugLogger io.Writer
 
 // WithCache specifies a cache with capacity cap.
 func WithCache(cap int) Option {
-	return func(r *Resolver) {
-		return
+	return func(r *BottinResolver) {
+		r.capacity = cap
+	}
+}
+
+// WithCacheOptions applies options to the cache of the Resolver, like WithMinTTL or WithMaxTTL.
+func WithCacheOptions(options ...CacheOption) Option {
+	return func(r *BottinResolver) {
+		r.cacheOptions = append(r.cacheOptions, options...)
+	}
+}
+
+// WithClock makes the Resolver and its cache tell the time with clock, for the expiry of records.
+func WithClock(clock Clock) Option {
+	return func(r *BottinResolver) {
+		r.clock = clock
 	}
 }
 
 // WithDialer sets a custom dialer for the Resolver.
 func WithDialer(dialer *net.Dialer) Option {
-	return func(r *Resolver) {
+	return func(r *BottinResolver) {
+		r.dialer = dialer
+	}
+}
+
+// WithExchanger sends the upstream queries of the Resolver through e, instead of a ClientExchanger.
+func WithExchanger(e Exchanger) Option {
+	return func(r *BottinResolver) {
+		r.exchanger = e
+	}
+}
+
+// WithRootHints starts resolutions from the root nameservers of hints, given in the format of
+// named.root, instead of the embedded root hints. NewResolver panics if hints can't be parsed.
+func WithRootHints(hints string) Option {
+	return func(r *BottinResolver) {
+		r.rootHints = hints
 	}
 }
 
 // WithExpiry sets an expiry duration for cached responses.
 func WithExpiry() Option {
-	return func(r *Resolver) {
+	return func(r *BottinResolver) {
+		r.expire = true
+	}
+}
+
+// WithServeStale keeps expired records in the cache for window, and answers with them when a
+// resolution fails or doesn't complete within clientTimeout, 0 to wait for it (RFC 8767). The
+// resolution carries on in the background to refresh the cache. Records only expire with WithExpiry.
+func WithServeStale(window, clientTimeout time.Duration) Option {
+	return func(r *BottinResolver) {
+		r.staleWindow = window
+		r.staleTimeout = clientTimeout
+	}
+}
+
+// WithPrefetch refreshes a cache entry in the background when it is hit with less than fraction of
+// its TTL left, after minHits hits, so that popular names don't expire. The hit is answered from
+// the cache right away. Records only expire with WithExpiry.
+func WithPrefetch(fraction float64, minHits int) Option {
+	return func(r *BottinResolver) {
+		r.prefetch = fraction
+		r.prefetchHits = minHits
+	}
+}
+
+// WithCaseRandomization randomizes the case of the names in outbound queries, and checks that
+// responses echo it, making spoofing harder (DNS 0x20). Servers found not to preserve case are
+// then queried without it.
+func WithCaseRandomization() Option {
+	return func(r *BottinResolver) {
+		r.randomizeCase = true
+	}
+}
+
+// WithQNameMinimization only sends the nameservers of each zone the labels of the query name they
+// need to find the next zone cut, hiding the full name from the root and TLD nameservers
+// (RFC 9156). Minimised names have at most maxLabels labels, 0 for no maximum, past which the full
+// query name is sent, bounding the number of queries for deep names.
+func WithQNameMinimization(mode QNameMinimization, maxLabels int) Option {
+	return func(r *BottinResolver) {
+		r.minimize = mode
+		r.minimizeLabels = maxLabels
+	}
+}
+
+// WithDNSSEC validates responses with DNSSEC, from the trust anchors of the root zone embedded in
+// root.key, or the ones of WithTrustAnchors. Results have the Security status of their records, and
+// Bogus responses fail with a *BogusError. DNSSEC records are asked for with the DO bit of EDNS0.
+func WithDNSSEC() Option {
+	return func(r *BottinResolver) {
+		r.dnssec = true
+	}
+}
+
+// WithTrustAnchors validates DNSSEC from anchors, DS or DNSKEY records in zone-file format, instead
+// of the embedded root trust anchors. NewResolver panics if anchors can't be parsed.
+func WithTrustAnchors(anchors string) Option {
+	return func(r *BottinResolver) {
+		r.trustAnchors = anchors
+	}
+}
+
+// WithTrustAnchorFile maintains the DNSSEC trust anchors with RFC 5011: the resolver watches the
+// DNSKEY RRset of each zone with a trust anchor, trusts the new key-signing keys after AddHoldDown,
+// and stops trusting the revoked ones. The state of the keys is saved to path, and the resolver
+// started with it trusts the keys it holds instead of the ones of WithTrustAnchors. It enables
+// WithDNSSEC. NewResolver panics if path exists but can't be read.
+func WithTrustAnchorFile(path string) Option {
+	return func(r *BottinResolver) {
+		r.dnssec = true
+		r.anchorFile = path
 	}
 }
 
+// WithTCPRetry retries a query over TCP when the UDP response is truncated.
 func WithTCPRetry() Option {
-	return func(r *Resolver) {
+	return func(r *BottinResolver) {
+		r.tcpRetry = true
+	}
+}
+
+// WithTCPZones always queries the nameservers of zones, and of the zones below them, over TCP.
+func WithTCPZones(zones ...string) Option {
+	return func(r *BottinResolver) {
+		for _, zone := range zones {
+			r.tcpZones = append(r.tcpZones, toLowerFQDN(zone))
+		}
+	}
+}
+
+// WithTCPServers always queries the nameservers at the given IP addresses over TCP.
+func WithTCPServers(addrs ...string) Option {
+	return func(r *BottinResolver) {
+		r.tcpServers = append(r.tcpServers, addrs...)
+	}
+}
+
+// WithEDNS0 advertises an EDNS0 UDP buffer size of size in outbound queries, 0 disabling EDNS0.
+func WithEDNS0(size uint16) Option {
+	return func(r *BottinResolver) {
+		r.ednsSize = size
+	}
+}
+
+// WithAddressFamily sets the address family policy used to pick nameserver addresses.
+func WithAddressFamily(family AddressFamily) Option {
+	return func(r *BottinResolver) {
+		r.family = family
+	}
+}
+
+// WithHedging queries another nameserver in parallel when the previous one hasn't answered within
+// its smoothed RTT.
+func WithHedging() Option {
+	return func(r *BottinResolver) {
+		r.hedge = true
+	}
+}
+
+// WithTraceWriter writes the resolution trace to w, in the format of slog.TextHandler.
+func WithTraceWriter(w io.Writer) Option {
+	return func(r *BottinResolver) {
+		r.logger = slog.New(slog.NewTextHandler(w, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	}
+}
+
+// WithTraceHandler sends the resolution trace to h, as records of the debug level.
+// A nil handler disables the trace.
+func WithTraceHandler(h slog.Handler) Option {
+	return func(r *BottinResolver) {
+		r.logger = nil
+		if h != nil {
+			r.logger = slog.New(h)
+		}
 	}
 }
 
 // WithTimeout sets a timeout for the Resolver's operations.
 func WithTimeout(timeout time.Duration) Option {
-	return func(r *Resolver) {
+	return func(r *BottinResolver) {
+		r.timeout = timeout
 	}
 }
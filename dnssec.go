@@ -0,0 +1,780 @@
+package bottin
+
+import (
+	"context"
+	_ "embed"
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// rootAnchors holds the DS records of the root key-signing keys, the default trust anchors.
+//
+//go:embed root.key
+var rootAnchors string
+
+// SecurityStatus is the DNSSEC status of resolution results (RFC 4035 section 4.3). Bogus aside,
+// the statuses are ordered from the least to the most trustworthy.
+type SecurityStatus int
+
+const (
+	Indeterminate SecurityStatus = iota // Not validated: validation is disabled, or no trust anchor applies.
+	Insecure                            // Proven unsigned, by a delegation without DS records on the way.
+	Secure                              // Signed, with a chain of trust from a trust anchor.
+	Bogus                               // Expected to be signed, but failing validation.
+)
+
+func (s SecurityStatus) String() string {
+	switch s {
+	case Indeterminate:
+		return "Indeterminate"
+	case Insecure:
+		return "Insecure"
+	case Secure:
+		return "Secure"
+	case Bogus:
+		return "Bogus"
+	}
+	return fmt.Sprintf("SecurityStatus(%d)", int(s))
+}
+
+// BogusError is returned in place of the records of a response failing DNSSEC validation.
+type BogusError struct {
+	Name   string // Name queried.
+	Type   string // Type queried.
+	Reason string // Why the validation failed.
+}
+
+func (e *BogusError) Error() string {
+	return fmt.Sprintf("DNSSEC validation failed for %s %s: %s", e.Name, e.Type, e.Reason)
+}
+
+// zoneKeys is the DNSSEC status of a zone, with its validated DNSKEY records if it is Secure.
+type zoneKeys struct {
+	status SecurityStatus
+	keys   []*dns.DNSKEY
+	reason string // Why the zone is Bogus.
+	expiry time.Time
+}
+
+// keyCache holds the DNSSEC status of the zones met by validating resolutions, until the records
+// it was established from expire.
+type keyCache struct {
+	zones map[string]zoneKeys
+	clock Clock
+	mutex sync.Mutex
+}
+
+func newKeyCache(clock Clock) *keyCache {
+	return &keyCache{zones: make(map[string]zoneKeys), clock: clock}
+}
+
+// get returns the unexpired status of zone.
+func (kc *keyCache) get(zone string) (zoneKeys, bool) {
+	kc.mutex.Lock()
+	defer kc.mutex.Unlock()
+	zk, ok := kc.zones[zone]
+	if !ok || !kc.clock.Now().Before(zk.expiry) {
+		return zoneKeys{}, false
+	}
+	return zk, true
+}
+
+// set stores the status of zone for ttl.
+func (kc *keyCache) set(zone string, zk zoneKeys, ttl time.Duration) {
+	kc.mutex.Lock()
+	defer kc.mutex.Unlock()
+	zk.expiry = kc.clock.Now().Add(ttl)
+	kc.zones[zone] = zk
+}
+
+// clear forgets the status of every zone, when the trust anchors change.
+func (kc *keyCache) clear() {
+	kc.mutex.Lock()
+	defer kc.mutex.Unlock()
+	clear(kc.zones)
+}
+
+// initAnchors parses the trust anchors, DS or DNSKEY records in zone-file format.
+func (br *BottinResolver) initAnchors() {
+	anchors := rootAnchors
+	if br.trustAnchors != "" {
+		anchors = br.trustAnchors
+	}
+	br.anchors = make(map[string][]dns.RR)
+	zp := dns.NewZoneParser(strings.NewReader(anchors), "", "")
+	for drr, ok := zp.Next(); ok; drr, ok = zp.Next() {
+		switch drr.(type) {
+		case *dns.DS, *dns.DNSKEY:
+			zone := toLowerFQDN(drr.Header().Name)
+			br.anchors[zone] = append(br.anchors[zone], drr)
+		}
+	}
+	if err := zp.Err(); err != nil {
+		panic(err)
+	}
+}
+
+// anchorsFor returns the trust anchors of zone, if it has some.
+func (br *BottinResolver) anchorsFor(zone string) ([]dns.RR, bool) {
+	br.anchorMutex.RLock()
+	defer br.anchorMutex.RUnlock()
+	anchors, ok := br.anchors[zone]
+	return anchors, ok
+}
+
+// zoneSecurity returns the DNSSEC status of zone, following the chain of trust down from a trust
+// anchor: a zone is Secure when its DNSKEY RRset is signed by a key matching the validated DS
+// records of its parent, and Insecure when its Secure parent proves it has none.
+func (br *BottinResolver) zoneSecurity(ctx context.Context, zone string, depth int) (zoneKeys, error) {
+	if zk, ok := br.keys.get(zone); ok {
+		return zk, nil
+	}
+	ctx, ok := withPending(ctx, zone+"|DS")
+	if !ok || depth > MaxRecursion {
+		return zoneKeys{}, ErrMaxRecursion
+	}
+
+	var zk zoneKeys
+	var ttl time.Duration
+	var err error
+	switch anchors, ok := br.anchorsFor(zone); {
+	case ok:
+		zk, ttl, err = br.zoneKeys(ctx, zone, anchors, depth)
+	case zone == ".":
+		return zoneKeys{status: Indeterminate}, nil // No trust anchor above.
+	default:
+		zk, ttl, err = br.delegationSecurity(ctx, zone, depth)
+	}
+	if err != nil {
+		return zoneKeys{}, err
+	}
+	br.trace(ctx, "dnssec zone", slog.String("zone", zone), slog.String("status", zk.status.String()))
+	if zk.status != Bogus {
+		br.keys.set(zone, zk, ttl)
+	}
+	return zk, nil
+}
+
+// delegationSecurity returns the DNSSEC status of zone from the DS records held by its parent zone,
+// and how long it holds.
+func (br *BottinResolver) delegationSecurity(ctx context.Context, zone string, depth int) (zoneKeys, time.Duration, error) {
+	resp, parentZone, err := br.descend(ctx, zone, "DS", depth+1)
+	if err != nil {
+		return zoneKeys{}, 0, err
+	}
+	parent, err := br.zoneSecurity(ctx, parentZone, depth+1)
+	if err != nil {
+		return zoneKeys{}, 0, err
+	}
+	ttl := minTTL(append(append([]dns.RR(nil), resp.Answer...), resp.Ns...))
+	if parent.status != Secure {
+		return zoneKeys{status: parent.status, reason: parent.reason}, ttl, nil
+	}
+
+	now := br.clock.Now()
+	ds, sigs := rrset(resp.Answer, zone, dns.TypeDS)
+	if len(ds) > 0 {
+		if _, err := verifyRRset(ds, sigs, parent.keys, parentZone, now); err != nil {
+			return bogus("DS of %s: %v", zone, err), 0, nil
+		}
+		return br.zoneKeys(ctx, zone, ds, depth)
+	}
+	if resp.Rcode != dns.RcodeSuccess {
+		return bogus("DS of %s: %s", zone, dns.RcodeToString[resp.Rcode]), 0, nil
+	}
+	insecure, err := verifyDenial(resp, parentZone, parent.keys, zone, dns.TypeDS, false, now)
+	if err != nil {
+		return bogus("no DS for %s: %v", zone, err), 0, nil
+	}
+	if insecure {
+		br.trace(ctx, "dnssec insecure denial", slog.String("zone", parentZone), slog.String("cut", zone))
+	} else if !delegated(resp, zone) {
+		// Without a zone cut, zone is part of its parent, and its records can't be Insecure.
+		return bogus("no DS for %s: not a delegation", zone), 0, nil
+	}
+	return zoneKeys{status: Insecure}, ttl, nil
+}
+
+// zoneKeys returns the DNSKEY records of zone, Secure if one of them matches one of anchors, DS or
+// DNSKEY records, and signs them, and how long it holds. A zone whose anchors all use unsupported
+// algorithms is Insecure (RFC 4035 section 5.2).
+func (br *BottinResolver) zoneKeys(ctx context.Context, zone string, anchors []dns.RR, depth int) (zoneKeys, time.Duration, error) {
+	if len(anchors) == 0 {
+		return bogus("no trusted key for %s", zone), 0, nil // All its trust anchors were revoked.
+	}
+	resp, _, err := br.descend(ctx, zone, "DNSKEY", depth+1)
+	if err != nil {
+		return zoneKeys{}, 0, err
+	}
+	rrs, sigs := rrset(resp.Answer, zone, dns.TypeDNSKEY)
+	var keys []*dns.DNSKEY
+	for _, drr := range rrs {
+		keys = append(keys, drr.(*dns.DNSKEY))
+	}
+
+	now := br.clock.Now()
+	supported := false
+	for _, anchor := range anchors {
+		if !supportedAnchor(anchor) {
+			continue
+		}
+		supported = true
+		for _, key := range keys {
+			if !matchesAnchor(key, anchor) {
+				continue
+			}
+			if _, err := verifyRRset(rrs, sigs, []*dns.DNSKEY{key}, zone, now); err == nil {
+				return zoneKeys{status: Secure, keys: keys}, minTTL(rrs), nil
+			}
+		}
+	}
+	if !supported {
+		return zoneKeys{status: Insecure}, minTTL(anchors), nil
+	}
+	return bogus("no DNSKEY of %s matching its DS records signs its DNSKEY records", zone), 0, nil
+}
+
+// validateResponse returns the DNSSEC status of resp, the response of the nameservers of zone
+// leading to target, and why it is Bogus. Each RRset of the answer section must be signed by its
+// zone, and so must the proof that target doesn't exist, or has no records of type qtype. The
+// nameservers of zone may also be authoritative for zones below it, whose records are validated
+// with their own keys, down the chain of trust from zone.
+func (br *BottinResolver) validateResponse(ctx context.Context, resp *dns.Msg, zone, target, qtype string, nxdomain, nodata bool, depth int) (SecurityStatus, string, error) {
+	zk, err := br.zoneSecurity(ctx, zone, depth)
+	if err != nil {
+		return Indeterminate, "", err
+	}
+	if zk.status != Secure {
+		return zk.status, zk.reason, nil
+	}
+	signers := map[string]zoneKeys{zone: zk}
+	signerKeys := func(sigs []*dns.RRSIG) (string, zoneKeys, error) {
+		signer, err := signerName(sigs, zone)
+		if err != nil {
+			return "", bogus("%v", err), nil
+		}
+		if zk, ok := signers[signer]; ok {
+			return signer, zk, nil
+		}
+		zk, err := br.zoneSecurity(ctx, signer, depth)
+		if err != nil {
+			return "", zoneKeys{}, err
+		}
+		signers[signer] = zk
+		return signer, zk, nil
+	}
+
+	now := br.clock.Now()
+	status := Secure
+	var dnames []*dns.DNAME
+	for _, drr := range resp.Answer {
+		if dname, ok := drr.(*dns.DNAME); ok {
+			dnames = append(dnames, dname)
+		}
+	}
+	var wildcards []string
+	for _, set := range rrsets(resp.Answer) {
+		rrs, sigs := rrset(resp.Answer, set.name, set.rrtype)
+		if set.rrtype == dns.TypeCNAME && synthesized(dnames, set.name) {
+			continue // The CNAME of a DNAME isn't signed, the DNAME is (RFC 6672 section 5.3.1).
+		}
+		signer, zk, err := signerKeys(sigs)
+		if err != nil {
+			return Indeterminate, "", err
+		}
+		if zk.status != Secure {
+			if zk.status == Bogus {
+				return Bogus, fmt.Sprintf("%s %s: %s", set.name, dns.TypeToString[set.rrtype], zk.reason), nil
+			}
+			status = min(status, zk.status)
+			continue
+		}
+		sig, err := verifyRRset(rrs, sigs, zk.keys, signer, now)
+		if err != nil {
+			return Bogus, fmt.Sprintf("%s %s: %v", set.name, dns.TypeToString[set.rrtype], err), nil
+		}
+		if int(sig.Labels) < dns.CountLabel(set.name) {
+			wildcards = append(wildcards, set.name)
+		}
+	}
+	if !nxdomain && !nodata && len(wildcards) == 0 {
+		return status, "", nil
+	}
+
+	// The proofs of nonexistence are signed by the zone of the authority section.
+	var sigs []*dns.RRSIG
+	for _, drr := range resp.Ns {
+		if sig, ok := drr.(*dns.RRSIG); ok {
+			sigs = append(sigs, sig)
+		}
+	}
+	signer, zk, err := signerKeys(sigs)
+	if err != nil {
+		return Indeterminate, "", err
+	}
+	if zk.status == Secure || zk.status == Insecure {
+		// The owner names of the signatures are those of the response: only a zone enclosing the
+		// names it denies, with its SOA at the apex, can deny them, or any insecure zone would.
+		if err := denyingZone(resp, signer, target, nxdomain || nodata, wildcards); err != nil {
+			return Bogus, err.Error(), nil
+		}
+	}
+	if zk.status != Secure {
+		return min(status, zk.status), zk.reason, nil
+	}
+	for _, name := range wildcards {
+		// The answer was synthesized from a wildcard, which requires that the name doesn't exist.
+		if err := verifyWildcard(resp, signer, zk.keys, name, now); err != nil {
+			return Bogus, fmt.Sprintf("wildcard answer for %s: %v", name, err), nil
+		}
+	}
+	if nxdomain || nodata {
+		dnsType := dns.StringToType[wireType(qtype)]
+		insecure, err := verifyDenial(resp, signer, zk.keys, target, dnsType, nxdomain, now)
+		if err != nil {
+			return Bogus, fmt.Sprintf("denial of %s %s: %v", target, wireType(qtype), err), nil
+		}
+		if insecure {
+			return min(status, Insecure), "", nil
+		}
+	}
+	return status, "", nil
+}
+
+// signerName returns the zone whose keys made sigs, the signatures of records from the nameservers
+// of zone: zone, or a zone below it they are also authoritative for, at or above the owner of the
+// records. It is zone if there are no signatures.
+func signerName(sigs []*dns.RRSIG, zone string) (string, error) {
+	for _, sig := range sigs {
+		signer := toLowerFQDN(sig.SignerName)
+		if dns.IsSubDomain(zone, signer) && dns.IsSubDomain(signer, toLowerFQDN(sig.Hdr.Name)) {
+			return signer, nil
+		}
+	}
+	if len(sigs) > 0 {
+		return "", fmt.Errorf("signer %s of %s outside of %s", sigs[0].SignerName, sigs[0].Hdr.Name, zone)
+	}
+	return zone, nil
+}
+
+// denyingZone checks that signer, the zone of the authority section of resp, encloses the names it
+// denies: target, if denied is set, and the names answered from wildcards. The SOA records of the
+// section must be at its apex.
+func denyingZone(resp *dns.Msg, signer, target string, denied bool, wildcards []string) error {
+	names := wildcards
+	if denied {
+		names = append([]string{target}, wildcards...)
+	}
+	for _, name := range names {
+		if !dns.IsSubDomain(signer, name) {
+			return fmt.Errorf("denial of %s signed by %s", name, signer)
+		}
+	}
+	for _, drr := range resp.Ns {
+		if soa, ok := drr.(*dns.SOA); ok && toLowerFQDN(soa.Hdr.Name) != signer {
+			return fmt.Errorf("SOA of %s in the denial signed by %s", soa.Hdr.Name, signer)
+		}
+	}
+	return nil
+}
+
+// bogus returns a Bogus zone status for the reason formatted from format and args.
+func bogus(format string, args ...any) zoneKeys {
+	return zoneKeys{status: Bogus, reason: fmt.Sprintf(format, args...)}
+}
+
+// rrsetKey identifies an RRset.
+type rrsetKey struct {
+	name   string
+	rrtype uint16
+}
+
+// rrsets returns the RRsets of section, signatures aside, in order.
+func rrsets(section []dns.RR) []rrsetKey {
+	var sets []rrsetKey
+	seen := make(map[rrsetKey]bool)
+	for _, drr := range section {
+		set := rrsetKey{toLowerFQDN(drr.Header().Name), drr.Header().Rrtype}
+		if set.rrtype != dns.TypeRRSIG && !seen[set] {
+			seen[set] = true
+			sets = append(sets, set)
+		}
+	}
+	return sets
+}
+
+// rrset returns the records of section with the given owner name and type, and their signatures.
+func rrset(section []dns.RR, name string, rrtype uint16) ([]dns.RR, []*dns.RRSIG) {
+	var rrs []dns.RR
+	var sigs []*dns.RRSIG
+	for _, drr := range section {
+		if toLowerFQDN(drr.Header().Name) != name {
+			continue
+		}
+		if sig, ok := drr.(*dns.RRSIG); ok && sig.TypeCovered == rrtype {
+			sigs = append(sigs, sig)
+		} else if drr.Header().Rrtype == rrtype {
+			rrs = append(rrs, drr)
+		}
+	}
+	return rrs, sigs
+}
+
+// verifyRRset returns the signature of rrset among sigs made by signer with one of keys, and valid
+// at now.
+func verifyRRset(rrs []dns.RR, sigs []*dns.RRSIG, keys []*dns.DNSKEY, signer string, now time.Time) (*dns.RRSIG, error) {
+	if len(rrs) == 0 {
+		return nil, fmt.Errorf("no records")
+	}
+	if len(sigs) == 0 {
+		return nil, fmt.Errorf("no signature")
+	}
+	err := fmt.Errorf("no signature by a key of %s", signer)
+	for _, sig := range sigs {
+		if toLowerFQDN(sig.SignerName) != signer || int(sig.Labels) > dns.CountLabel(rrs[0].Header().Name) {
+			continue
+		}
+		if !sig.ValidityPeriod(now) {
+			err = fmt.Errorf("signature outside of its validity period")
+			continue
+		}
+		for _, key := range keys {
+			if key.KeyTag() != sig.KeyTag || key.Algorithm != sig.Algorithm {
+				continue
+			}
+			if verifyErr := sig.Verify(key, rrs); verifyErr != nil {
+				err = fmt.Errorf("bad signature: %v", verifyErr)
+				continue
+			}
+			return sig, nil
+		}
+	}
+	return nil, err
+}
+
+// verifyDenial checks that the signed NSEC or NSEC3 records of the authority section of resp prove
+// that name doesn't exist, if nxdomain is set, or has no records of type qtype. insecure is set when
+// the proof only shows that the name may be below an unsigned delegation, covered by an opt-out NSEC3
+// (RFC 5155 section 9.2), or when its NSEC3 records have more than MaxNSEC3Iterations, too costly
+// to check (RFC 9276 section 3.2).
+func verifyDenial(resp *dns.Msg, zone string, keys []*dns.DNSKEY, name string, qtype uint16, nxdomain bool, now time.Time) (insecure bool, err error) {
+	if err := verifyAuthority(resp, zone, keys, now); err != nil {
+		return false, err
+	}
+	nsecs, nsec3s := denialRecords(resp)
+	for _, nsec3 := range nsec3s {
+		if int(nsec3.Iterations) > MaxNSEC3Iterations {
+			return true, nil
+		}
+	}
+	switch {
+	case len(nsecs) > 0 && nxdomain:
+		return false, nsecNameError(nsecs, name)
+	case len(nsecs) > 0:
+		return false, nsecNoData(nsecs, name, qtype)
+	case len(nsec3s) > 0 && nxdomain:
+		return nsec3NameError(nsec3s, name)
+	case len(nsec3s) > 0:
+		return nsec3NoData(nsec3s, name, qtype)
+	}
+	return false, fmt.Errorf("no NSEC or NSEC3 records")
+}
+
+// verifyWildcard checks that the signed NSEC or NSEC3 records of the authority section of resp
+// prove that name, answered from a wildcard, doesn't exist itself (RFC 4035 section 5.3.4).
+func verifyWildcard(resp *dns.Msg, zone string, keys []*dns.DNSKEY, name string, now time.Time) error {
+	if err := verifyAuthority(resp, zone, keys, now); err != nil {
+		return err
+	}
+	nsecs, nsec3s := denialRecords(resp)
+	for _, nsec := range nsecs {
+		if nsecCovers(nsec, name) {
+			return nil
+		}
+	}
+	for _, nsec3 := range nsec3s {
+		if nsec3.Cover(name) {
+			return nil
+		}
+	}
+	return fmt.Errorf("no proof that the name doesn't exist")
+}
+
+// verifyAuthority checks the signatures of the RRsets of the authority section of resp, but for
+// the NS records of the zone, which may be unsigned.
+func verifyAuthority(resp *dns.Msg, zone string, keys []*dns.DNSKEY, now time.Time) error {
+	for _, set := range rrsets(resp.Ns) {
+		if set.rrtype == dns.TypeNS {
+			continue
+		}
+		rrs, sigs := rrset(resp.Ns, set.name, set.rrtype)
+		if _, err := verifyRRset(rrs, sigs, keys, zone, now); err != nil {
+			return fmt.Errorf("%s %s: %v", set.name, dns.TypeToString[set.rrtype], err)
+		}
+	}
+	return nil
+}
+
+// delegated reports whether the NSEC or NSEC3 record of name in the authority section of resp shows
+// it is a delegation, with NS records.
+func delegated(resp *dns.Msg, name string) bool {
+	nsecs, nsec3s := denialRecords(resp)
+	for _, nsec := range nsecs {
+		if toLowerFQDN(nsec.Hdr.Name) == name {
+			return hasType(nsec.TypeBitMap, dns.TypeNS)
+		}
+	}
+	for _, nsec3 := range nsec3s {
+		if nsec3.Match(name) {
+			return hasType(nsec3.TypeBitMap, dns.TypeNS)
+		}
+	}
+	return false
+}
+
+// denialRecords returns the NSEC and NSEC3 records of the authority section of resp.
+func denialRecords(resp *dns.Msg) ([]*dns.NSEC, []*dns.NSEC3) {
+	var nsecs []*dns.NSEC
+	var nsec3s []*dns.NSEC3
+	for _, drr := range resp.Ns {
+		switch rr := drr.(type) {
+		case *dns.NSEC:
+			nsecs = append(nsecs, rr)
+		case *dns.NSEC3:
+			nsec3s = append(nsec3s, rr)
+		}
+	}
+	return nsecs, nsec3s
+}
+
+// nsecNameError checks that nsecs prove that name doesn't exist, and that no wildcard of its
+// closest encloser does either (RFC 4035 section 5.4).
+func nsecNameError(nsecs []*dns.NSEC, name string) error {
+	var cover *dns.NSEC
+	for _, nsec := range nsecs {
+		if nsecCovers(nsec, name) {
+			cover = nsec
+		}
+	}
+	if cover == nil {
+		return fmt.Errorf("no NSEC covering %s", name)
+	}
+
+	// The closest encloser is the longest existing ancestor of name, found around the gap.
+	labels := max(dns.CompareDomainName(name, cover.Hdr.Name), dns.CompareDomainName(name, cover.NextDomain))
+	wildcard := "*." + ancestor(name, labels)
+	if wildcard == "*.." {
+		wildcard = "*."
+	}
+	for _, nsec := range nsecs {
+		if nsecCovers(nsec, wildcard) {
+			return nil
+		}
+	}
+	return fmt.Errorf("no NSEC covering %s", wildcard)
+}
+
+// nsecNoData checks that nsecs prove that name has no records of type qtype: its NSEC doesn't have
+// the type, nor CNAME, or it is an empty non-terminal.
+func nsecNoData(nsecs []*dns.NSEC, name string, qtype uint16) error {
+	for _, nsec := range nsecs {
+		if toLowerFQDN(nsec.Hdr.Name) == name {
+			if hasType(nsec.TypeBitMap, qtype) || hasType(nsec.TypeBitMap, dns.TypeCNAME) {
+				return fmt.Errorf("NSEC of %s has type %s", name, dns.TypeToString[qtype])
+			}
+			return denialSide(nsec.TypeBitMap, "NSEC", name, qtype)
+		}
+		if nsecCovers(nsec, name) && dns.IsSubDomain(name, toLowerFQDN(nsec.NextDomain)) {
+			return nil // Empty non-terminal: names exist below name.
+		}
+	}
+	return fmt.Errorf("no NSEC for %s", name)
+}
+
+// denialSide checks that the NSEC or NSEC3 record of name with bitmap, of the given kind, comes from
+// the zone that can deny its records of type qtype. The record of the parent side of a delegation,
+// with NS but not SOA, only proves that there is no DS (RFC 4035 section 5.2, RFC 5155 section 8.9),
+// and the record of the apex of the child zone, with SOA, can't prove that (RFC 6840 section 4.4).
+func denialSide(bitmap []uint16, kind, name string, qtype uint16) error {
+	cut := hasType(bitmap, dns.TypeNS) && !hasType(bitmap, dns.TypeSOA)
+	switch {
+	case qtype != dns.TypeDS && cut:
+		return fmt.Errorf("%s of the delegation %s only denies DS", kind, name)
+	case qtype == dns.TypeDS && hasType(bitmap, dns.TypeSOA) && name != ".":
+		return fmt.Errorf("%s of the apex %s can't deny DS", kind, name)
+	}
+	return nil
+}
+
+// nsec3NameError checks that nsec3s prove that name doesn't exist, with a closest encloser proof
+// and the denial of its wildcard (RFC 5155 section 8.4). optOut is set when the next closer name is
+// covered by an opt-out NSEC3, which leaves room for an unsigned delegation.
+func nsec3NameError(nsec3s []*dns.NSEC3, name string) (optOut bool, err error) {
+	closest, next, err := closestEncloser(nsec3s, name)
+	if err != nil {
+		return false, err
+	}
+	cover := nsec3Covering(nsec3s, next)
+	if cover == nil {
+		return false, fmt.Errorf("no NSEC3 covering %s", next)
+	}
+	wildcard := "*." + closest
+	if closest == "." {
+		wildcard = "*."
+	}
+	if nsec3Covering(nsec3s, wildcard) == nil {
+		return false, fmt.Errorf("no NSEC3 covering %s", wildcard)
+	}
+	return cover.Flags&1 == 1, nil
+}
+
+// nsec3NoData checks that nsec3s prove that name has no records of type qtype (RFC 5155 section
+// 8.5), or, for DS records, that name is an unsigned delegation covered by an opt-out NSEC3 (RFC
+// 5155 section 8.6).
+func nsec3NoData(nsec3s []*dns.NSEC3, name string, qtype uint16) (optOut bool, err error) {
+	for _, nsec3 := range nsec3s {
+		if nsec3.Match(name) {
+			if hasType(nsec3.TypeBitMap, qtype) || hasType(nsec3.TypeBitMap, dns.TypeCNAME) {
+				return false, fmt.Errorf("NSEC3 of %s has type %s", name, dns.TypeToString[qtype])
+			}
+			return false, denialSide(nsec3.TypeBitMap, "NSEC3", name, qtype)
+		}
+	}
+	if qtype != dns.TypeDS {
+		return false, fmt.Errorf("no NSEC3 matching %s", name)
+	}
+	_, next, err := closestEncloser(nsec3s, name)
+	if err != nil {
+		return false, err
+	}
+	if cover := nsec3Covering(nsec3s, next); cover == nil || cover.Flags&1 == 0 {
+		return false, fmt.Errorf("no opt-out NSEC3 covering %s", next)
+	}
+	return true, nil
+}
+
+// closestEncloser returns the closest encloser of name proven by nsec3s, its longest ancestor with
+// a matching NSEC3, and the next closer name, one label longer toward name.
+func closestEncloser(nsec3s []*dns.NSEC3, name string) (closest, next string, err error) {
+	next = name
+	for closest, ok := parent(name); ok; closest, ok = parent(closest) {
+		for _, nsec3 := range nsec3s {
+			if nsec3.Match(closest) {
+				return closest, next, nil
+			}
+		}
+		next = closest
+	}
+	return "", "", fmt.Errorf("no closest encloser for %s", name)
+}
+
+// nsec3Covering returns the NSEC3 of nsec3s covering name, nil if there is none.
+func nsec3Covering(nsec3s []*dns.NSEC3, name string) *dns.NSEC3 {
+	for _, nsec3 := range nsec3s {
+		if nsec3.Cover(name) {
+			return nsec3
+		}
+	}
+	return nil
+}
+
+// nsecCovers reports whether name falls strictly between the owner and the next name of nsec, in
+// the canonical order. The last NSEC of a zone wraps around to its apex.
+func nsecCovers(nsec *dns.NSEC, name string) bool {
+	owner, next := nsec.Hdr.Name, nsec.NextDomain
+	if canonicalCompare(owner, name) >= 0 {
+		return false
+	}
+	return canonicalCompare(name, next) < 0 || canonicalCompare(next, owner) <= 0
+}
+
+// canonicalCompare compares the names a and b in the canonical DNS name order, label by label
+// from the root, ignoring case (RFC 4034 section 6.1).
+func canonicalCompare(a, b string) int {
+	la := dns.SplitDomainName(strings.ToLower(a))
+	lb := dns.SplitDomainName(strings.ToLower(b))
+	for i := 1; i <= len(la) && i <= len(lb); i++ {
+		if c := strings.Compare(la[len(la)-i], lb[len(lb)-i]); c != 0 {
+			return c
+		}
+	}
+	return len(la) - len(lb)
+}
+
+// ancestor returns the ancestor of name with its last labels labels.
+func ancestor(name string, labels int) string {
+	parts := dns.SplitDomainName(name)
+	return toLowerFQDN(strings.Join(parts[len(parts)-labels:], "."))
+}
+
+// synthesized reports whether the CNAME of name may have been synthesized from one of dnames.
+func synthesized(dnames []*dns.DNAME, name string) bool {
+	for _, dname := range dnames {
+		owner := toLowerFQDN(dname.Hdr.Name)
+		if owner != name && dns.IsSubDomain(owner, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// hasType reports whether the type bitmap of an NSEC or NSEC3 record has rrtype.
+func hasType(bitmap []uint16, rrtype uint16) bool {
+	for _, t := range bitmap {
+		if t == rrtype {
+			return true
+		}
+	}
+	return false
+}
+
+// supportedAnchor reports whether anchor, a DS or DNSKEY record, uses algorithms the validator
+// implements.
+func supportedAnchor(anchor dns.RR) bool {
+	switch rr := anchor.(type) {
+	case *dns.DS:
+		return supportedAlgorithm(rr.Algorithm) && (rr.DigestType == dns.SHA1 || rr.DigestType == dns.SHA256 || rr.DigestType == dns.SHA384)
+	case *dns.DNSKEY:
+		return supportedAlgorithm(rr.Algorithm)
+	}
+	return false
+}
+
+func supportedAlgorithm(algorithm uint8) bool {
+	switch algorithm {
+	case dns.RSASHA1, dns.RSASHA1NSEC3SHA1, dns.RSASHA256, dns.RSASHA512, dns.ECDSAP256SHA256, dns.ECDSAP384SHA384, dns.ED25519:
+		return true
+	}
+	return false
+}
+
+// matchesAnchor reports whether key is the key of anchor, a DS or DNSKEY record.
+func matchesAnchor(key *dns.DNSKEY, anchor dns.RR) bool {
+	switch rr := anchor.(type) {
+	case *dns.DS:
+		if key.KeyTag() != rr.KeyTag || key.Algorithm != rr.Algorithm {
+			return false
+		}
+		ds := key.ToDS(rr.DigestType)
+		return ds != nil && strings.EqualFold(ds.Digest, rr.Digest)
+	case *dns.DNSKEY:
+		return key.Flags == rr.Flags && key.Protocol == rr.Protocol && key.Algorithm == rr.Algorithm && key.PublicKey == rr.PublicKey
+	}
+	return false
+}
+
+// minTTL returns the lowest TTL of rrs, 0 if there are none.
+func minTTL(rrs []dns.RR) time.Duration {
+	var ttl uint32
+	for i, drr := range rrs {
+		if i == 0 || drr.Header().Ttl < ttl {
+			ttl = drr.Header().Ttl
+		}
+	}
+	return time.Duration(ttl) * time.Second
+}
@@ -0,0 +1,412 @@
+package bottin
+
+import (
+	"context"
+	"crypto"
+	"errors"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/nbio/st"
+
+	"github.com/kakwa/bottin/bottintest"
+)
+
+const (
+	testSignedRootZone = `
+.                       86400   IN SOA a.root-servers.net. nstld.verisign-grs.com. 1 1800 900 604800 86400
+.                       518400  IN NS  a.root-servers.net.
+a.root-servers.net.     518400  IN A   198.41.0.4
+example.                172800  IN NS  ns.example.
+ns.example.             172800  IN A   192.0.2.1
+unsigned.               172800  IN NS  ns.unsigned.
+ns.unsigned.            172800  IN A   192.0.2.2
+`
+	testSignedZone = `
+example.                3600    IN SOA ns.example. hostmaster.example. 1 1800 900 604800 300
+example.                3600    IN NS  ns.example.
+ns.example.             3600    IN A   192.0.2.1
+www.example.            3600    IN A   192.0.2.10
+alias.example.          3600    IN CNAME www.example.
+a.b.example.            3600    IN A   192.0.2.11
+ins.example.            3600    IN NS  ns.example.
+`
+	testUnsignedZone = `
+unsigned.               3600    IN SOA ns.unsigned. hostmaster.unsigned. 1 1800 900 604800 300
+unsigned.               3600    IN NS  ns.unsigned.
+ns.unsigned.            3600    IN A   192.0.2.2
+www.unsigned.           3600    IN A   192.0.2.20
+`
+)
+
+// signedNetwork is a simulated hierarchy with a signed root, a signed zone example. and an unsigned
+// zone unsigned.
+type signedNetwork struct {
+	*bottintest.Network
+	anchor  string // DS record of the root KSK.
+	example *bottintest.Server
+}
+
+func newSignedNetwork(t *testing.T) *signedNetwork {
+	rootKSK, err := bottintest.NewKey(".", true)
+	st.Assert(t, err, nil)
+	rootZSK, err := bottintest.NewKey(".", false)
+	st.Assert(t, err, nil)
+	exampleKey, err := bottintest.NewKey("example.", true)
+	st.Assert(t, err, nil)
+
+	root, err := bottintest.NewServer(testSignedRootZone + exampleKey.DS().String() + "\n")
+	st.Assert(t, err, nil)
+	st.Assert(t, root.Sign(".", rootKSK, rootZSK), nil)
+	example, err := bottintest.NewServer(testSignedZone)
+	st.Assert(t, err, nil)
+	st.Assert(t, example.Sign("example.", exampleKey), nil)
+	unsigned, err := bottintest.NewServer(testUnsignedZone)
+	st.Assert(t, err, nil)
+
+	n := bottintest.NewNetwork()
+	n.Add(root, rootHintAddrs()...)
+	n.Add(example, "192.0.2.1")
+	n.Add(unsigned, "192.0.2.2")
+	return &signedNetwork{Network: n, anchor: rootKSK.DS().String(), example: example}
+}
+
+func (n *signedNetwork) resolver(options ...Option) *BottinResolver {
+	return NewResolver(append([]Option{WithExchanger(n), WithDNSSEC(), WithTrustAnchors(n.anchor)}, options...)...)
+}
+
+func TestDNSSECSecure(t *testing.T) {
+	r := newSignedNetwork(t).resolver()
+
+	rrs, err := r.ResolveErr("www.example", "A")
+	st.Expect(t, err, nil)
+	st.Expect(t, rrs.Security, Secure)
+	st.Expect(t, count(rrs.AnswerRRs, func(rr RR) bool { return rr.Type == "A" }), 1)
+	st.Expect(t, count(rrs.AnswerRRs, func(rr RR) bool { return rr.Type == "RRSIG" }), 0)
+
+	rrs, err = r.ResolveErr("alias.example", "A")
+	st.Expect(t, err, nil)
+	st.Expect(t, rrs.Security, Secure)
+	st.Expect(t, rrs.AnswerRRs[0].Type, "CNAME")
+
+	// From the cache.
+	rrs, err = r.ResolveErr("www.example", "A")
+	st.Expect(t, err, nil)
+	st.Expect(t, rrs.Security, Secure)
+}
+
+func TestDNSSECDenial(t *testing.T) {
+	r := newSignedNetwork(t).resolver()
+
+	rrs, err := r.ResolveErr("nope.example", "A")
+	st.Expect(t, err, NXDOMAIN)
+	st.Expect(t, rrs.Security, Secure)
+
+	rrs, err = r.ResolveErr("www.example", "AAAA")
+	st.Expect(t, err, nil)
+	st.Expect(t, rrs.Security, Secure)
+	st.Expect(t, len(rrs.AuthorityRRs), 1)
+
+	// b.example is an empty non-terminal.
+	rrs, err = r.ResolveErr("b.example", "A")
+	st.Expect(t, err, nil)
+	st.Expect(t, rrs.Security, Secure)
+
+	rrs, err = r.ResolveErr("nope.example", "A")
+	st.Expect(t, err, NXDOMAIN)
+	st.Expect(t, rrs.Security, Secure)
+}
+
+func TestDNSSECInsecure(t *testing.T) {
+	r := newSignedNetwork(t).resolver()
+	rrs, err := r.ResolveErr("www.unsigned", "A")
+	st.Expect(t, err, nil)
+	st.Expect(t, rrs.Security, Insecure)
+	st.Expect(t, count(rrs.AnswerRRs, func(rr RR) bool { return rr.Type == "A" }), 1)
+}
+
+func TestDNSSECIndeterminate(t *testing.T) {
+	n := newSignedNetwork(t)
+	r := NewResolver(WithExchanger(n))
+	rrs, err := r.ResolveErr("www.example", "A")
+	st.Expect(t, err, nil)
+	st.Expect(t, rrs.Security, Indeterminate)
+}
+
+func TestDNSSECBogus(t *testing.T) {
+	tests := []struct {
+		name   string
+		mangle func(resp *dns.Msg)
+	}{
+		{"bad signature", func(resp *dns.Msg) {
+			for _, rr := range resp.Answer {
+				if a, ok := rr.(*dns.A); ok {
+					a.A[3]++
+				}
+			}
+		}},
+		{"no signature", func(resp *dns.Msg) {
+			var answer []dns.RR
+			for _, rr := range resp.Answer {
+				if rr.Header().Rrtype != dns.TypeRRSIG {
+					answer = append(answer, rr)
+				}
+			}
+			resp.Answer = answer
+		}},
+		{"signer below the zone cut", func(resp *dns.Msg) {
+			for _, rr := range resp.Answer {
+				if sig, ok := rr.(*dns.RRSIG); ok && sig.TypeCovered == dns.TypeA {
+					sig.SignerName = "www.example." // Not a zone, proven by the NSEC of www.example.
+				}
+			}
+		}},
+		{"denial signed by an insecure zone", func(resp *dns.Msg) {
+			// Insecure, the records of ins.example. need no valid signature to be trusted.
+			if resp.Question[0].Qtype == dns.TypeA && resp.Question[0].Name == "www.example." {
+				resp.Rcode = dns.RcodeNameError
+				resp.Answer = nil
+				resp.Ns = []dns.RR{
+					&dns.SOA{Hdr: dns.RR_Header{Name: "ins.example.", Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: 300},
+						Ns: "ns.example.", Mbox: "hostmaster.example.", Serial: 1, Minttl: 300},
+					&dns.RRSIG{Hdr: dns.RR_Header{Name: "ins.example.", Rrtype: dns.TypeRRSIG, Class: dns.ClassINET, Ttl: 300},
+						TypeCovered: dns.TypeSOA, Algorithm: dns.ECDSAP256SHA256, Labels: 2, OrigTtl: 300,
+						Expiration: uint32(time.Now().Add(time.Hour).Unix()), Inception: uint32(time.Now().Unix()),
+						SignerName: "ins.example.", Signature: "AAAA"},
+				}
+			}
+		}},
+		{"forged denial", func(resp *dns.Msg) {
+			if resp.Question[0].Qtype == dns.TypeA && resp.Question[0].Name == "www.example." {
+				resp.Rcode = dns.RcodeNameError
+				resp.Answer = nil
+			}
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			n := newSignedNetwork(t)
+			n.example.Mangle = test.mangle
+			r := n.resolver()
+
+			rrs, err := r.ResolveErr("www.example", "A")
+			var bogus *BogusError
+			st.Expect(t, errors.As(err, &bogus), true)
+			st.Expect(t, bogus.Name, "www.example.")
+			st.Expect(t, bogus.Type, "A")
+			st.Expect(t, len(rrs.AnswerRRs), 0)
+			_, found := r.cache.Get("www.example.|A")
+			st.Expect(t, found, false)
+		})
+	}
+}
+
+// TestDNSSECCoHosted validates the records of a zone served by the nameservers of its parent zone,
+// signed with its own keys.
+func TestDNSSECCoHosted(t *testing.T) {
+	rootKey, err := bottintest.NewKey(".", true)
+	st.Assert(t, err, nil)
+	exampleKey, err := bottintest.NewKey("example.", true)
+	st.Assert(t, err, nil)
+	subKey, err := bottintest.NewKey("sub.example.", true)
+	st.Assert(t, err, nil)
+
+	root, err := bottintest.NewServer(testSignedRootZone + exampleKey.DS().String() + "\n")
+	st.Assert(t, err, nil)
+	st.Assert(t, root.Sign(".", rootKey), nil)
+	example, err := bottintest.NewServer(testSignedZone+`
+sub.example.            3600    IN NS  ns.example.
+`+subKey.DS().String()+"\n", `
+sub.example.            3600    IN SOA ns.example. hostmaster.example. 1 1800 900 604800 300
+sub.example.            3600    IN NS  ns.example.
+www.sub.example.        3600    IN A   192.0.2.30
+`)
+	st.Assert(t, err, nil)
+	st.Assert(t, example.Sign("example.", exampleKey), nil)
+	st.Assert(t, example.Sign("sub.example.", subKey), nil)
+
+	n := bottintest.NewNetwork()
+	n.Add(root, rootHintAddrs()...)
+	n.Add(example, "192.0.2.1")
+	r := NewResolver(WithExchanger(n), WithDNSSEC(), WithTrustAnchors(rootKey.DS().String()))
+
+	rrs, err := r.ResolveErr("www.sub.example", "A")
+	st.Expect(t, err, nil)
+	st.Expect(t, rrs.Security, Secure)
+	st.Expect(t, rrs.AnswerRRs[0].Value, "192.0.2.30")
+
+	rrs, err = r.ResolveErr("nope.sub.example", "A")
+	st.Expect(t, err, NXDOMAIN)
+	st.Expect(t, rrs.Security, Secure)
+
+	rrs, err = r.ResolveErr("www.example", "A")
+	st.Expect(t, err, nil)
+	st.Expect(t, rrs.Security, Secure)
+}
+
+func TestDNSSECWrongAnchor(t *testing.T) {
+	other, err := bottintest.NewKey(".", true)
+	st.Assert(t, err, nil)
+	n := newSignedNetwork(t)
+	r := NewResolver(WithExchanger(n), WithDNSSEC(), WithTrustAnchors(other.DS().String()))
+
+	_, err = r.ResolveErr("www.unsigned", "A")
+	var bogus *BogusError
+	st.Expect(t, errors.As(err, &bogus), true)
+}
+
+func TestRootAnchors(t *testing.T) {
+	r := NewResolver(WithDNSSEC())
+	st.Expect(t, len(r.anchors["."]), 2)
+	for _, anchor := range r.anchors["."] {
+		st.Expect(t, supportedAnchor(anchor), true)
+	}
+}
+
+func TestCanonicalCompare(t *testing.T) {
+	// The canonical order of RFC 4034 section 6.1.
+	names := []string{
+		"example.", "a.example.", "yljkjljk.a.example.", "Z.a.example.", "zABC.a.EXAMPLE.",
+		"z.example.", "\\001.z.example.", "*.z.example.", "\\200.z.example.",
+	}
+	sorted := append([]string(nil), names...)
+	sort.Slice(sorted, func(i, j int) bool { return canonicalCompare(sorted[i], sorted[j]) < 0 })
+	st.Expect(t, sorted[:6], names[:6])
+}
+
+// nsec3Chain returns an NSEC3 chain of the zone example. holding example. and www.example.
+func nsec3Chain(flags uint8, iterations uint16) []*dns.NSEC3 {
+	names := []string{"example.", "www.example."}
+	types := map[string][]uint16{"example.": {dns.TypeSOA, dns.TypeNS}, "www.example.": {dns.TypeA}}
+	hashes := make(map[string]string)
+	var sorted []string
+	for _, name := range names {
+		hash := dns.HashName(name, dns.SHA1, iterations, "")
+		hashes[hash] = name
+		sorted = append(sorted, hash)
+	}
+	sort.Strings(sorted)
+	var nsec3s []*dns.NSEC3
+	for i, hash := range sorted {
+		nsec3s = append(nsec3s, &dns.NSEC3{
+			Hdr:        dns.RR_Header{Name: strings.ToLower(hash) + ".example.", Rrtype: dns.TypeNSEC3, Class: dns.ClassINET, Ttl: 300},
+			Hash:       dns.SHA1,
+			Flags:      flags,
+			Iterations: iterations,
+			NextDomain: sorted[(i+1)%len(sorted)],
+			TypeBitMap: types[hashes[hash]],
+		})
+	}
+	return nsec3s
+}
+
+func TestNSEC3Denial(t *testing.T) {
+	nsec3s := nsec3Chain(0, 0)
+
+	optOut, err := nsec3NameError(nsec3s, "nope.example.")
+	st.Expect(t, err, nil)
+	st.Expect(t, optOut, false)
+	_, err = nsec3NameError(nsec3s, "www.example.")
+	st.Expect(t, err != nil, true)
+
+	_, err = nsec3NoData(nsec3s, "www.example.", dns.TypeAAAA)
+	st.Expect(t, err, nil)
+	_, err = nsec3NoData(nsec3s, "www.example.", dns.TypeA)
+	st.Expect(t, err != nil, true)
+	_, err = nsec3NoData(nsec3s, "nope.example.", dns.TypeDS)
+	st.Expect(t, err != nil, true) // Not opt-out.
+
+	nsec3s[0].Flags, nsec3s[1].Flags = 1, 1
+	optOut, err = nsec3NoData(nsec3s, "nope.example.", dns.TypeDS)
+	st.Expect(t, err, nil)
+	st.Expect(t, optOut, true)
+}
+
+// TestNSEC3InsecureDenial validates NXDOMAIN responses whose NSEC3 records can't prove that the
+// name doesn't exist in a signed zone.
+func TestNSEC3InsecureDenial(t *testing.T) {
+	key := &dns.DNSKEY{
+		Hdr:       dns.RR_Header{Name: "example.", Rrtype: dns.TypeDNSKEY, Class: dns.ClassINET, Ttl: 3600},
+		Flags:     dns.ZONE,
+		Protocol:  3,
+		Algorithm: dns.ECDSAP256SHA256,
+	}
+	priv, err := key.Generate(256)
+	st.Assert(t, err, nil)
+
+	tests := []struct {
+		name       string
+		flags      uint8
+		iterations uint16
+		status     SecurityStatus
+	}{
+		{"secure", 0, 0, Secure},
+		{"opt-out", 1, 0, Insecure}, // An unsigned delegation may hold the name.
+		{"too many iterations", 0, uint16(MaxNSEC3Iterations + 1), Insecure},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			resp := new(dns.Msg)
+			resp.SetQuestion("nope.example.", dns.TypeA)
+			resp.Rcode = dns.RcodeNameError
+			now := time.Now()
+			for _, nsec3 := range nsec3Chain(test.flags, test.iterations) {
+				sig := &dns.RRSIG{
+					Algorithm:  key.Algorithm,
+					Expiration: uint32(now.Add(time.Hour).Unix()),
+					Inception:  uint32(now.Add(-time.Hour).Unix()),
+					KeyTag:     key.KeyTag(),
+					SignerName: "example.",
+				}
+				st.Assert(t, sig.Sign(priv.(crypto.Signer), []dns.RR{nsec3}), nil)
+				resp.Ns = append(resp.Ns, nsec3, sig)
+			}
+
+			r := NewResolver(WithDNSSEC())
+			r.keys.set("example.", zoneKeys{status: Secure, keys: []*dns.DNSKEY{key}}, time.Hour)
+			status, reason, err := r.validateResponse(context.Background(), resp, "example.", "nope.example.", "A", true, false, 0)
+			st.Expect(t, err, nil)
+			st.Expect(t, reason, "")
+			st.Expect(t, status, test.status)
+		})
+	}
+}
+
+func TestDenialDelegation(t *testing.T) {
+	bitmaps := map[string][]uint16{
+		"example.":     {dns.TypeSOA, dns.TypeNS, dns.TypeRRSIG, dns.TypeNSEC, dns.TypeDNSKEY},
+		"sub.example.": {dns.TypeNS, dns.TypeRRSIG, dns.TypeNSEC}, // Parent side of a delegation.
+	}
+	tests := []struct {
+		name  string
+		qtype uint16
+		ok    bool
+	}{
+		{"sub.example.", dns.TypeDS, true},
+		{"sub.example.", dns.TypeA, false},
+		{"sub.example.", dns.TypeDNSKEY, false},
+		{"example.", dns.TypeA, true},
+		{"example.", dns.TypeDS, false},
+	}
+	for _, test := range tests {
+		nsec := &dns.NSEC{
+			Hdr:        dns.RR_Header{Name: test.name, Rrtype: dns.TypeNSEC, Class: dns.ClassINET},
+			NextDomain: "www.example.",
+			TypeBitMap: bitmaps[test.name],
+		}
+		err := nsecNoData([]*dns.NSEC{nsec}, test.name, test.qtype)
+		st.Expect(t, err == nil, test.ok)
+
+		nsec3 := &dns.NSEC3{
+			Hdr:        dns.RR_Header{Name: strings.ToLower(dns.HashName(test.name, dns.SHA1, 0, "")) + ".example.", Rrtype: dns.TypeNSEC3, Class: dns.ClassINET},
+			Hash:       dns.SHA1,
+			NextDomain: "00000000000000000000000000000000",
+			TypeBitMap: bitmaps[test.name],
+		}
+		_, err = nsec3NoData([]*dns.NSEC3{nsec3}, test.name, test.qtype)
+		st.Expect(t, err == nil, test.ok)
+	}
+}
@@ -0,0 +1,66 @@
+package bottin
+
+import "net"
+
+// AddressFamily is a policy for the IP address families of the nameservers a resolver queries.
+type AddressFamily int
+
+const (
+	PreferIPv4    AddressFamily = iota // IPv4 addresses first, then IPv6 ones.
+	PreferIPv6                         // IPv6 addresses first, then IPv4 ones.
+	IPv4Only                           // IPv4 addresses only.
+	IPv6Only                           // IPv6 addresses only.
+	HappyEyeballs                      // Alternate IPv6 and IPv4 addresses, racing them (RFC 8305).
+)
+
+// qtypes returns the address record types usable with the policy, in the order it prefers.
+func (f AddressFamily) qtypes() []string {
+	switch f {
+	case IPv4Only:
+		return []string{"A"}
+	case IPv6Only:
+		return []string{"AAAA"}
+	case PreferIPv6, HappyEyeballs:
+		return []string{"AAAA", "A"}
+	default:
+		return []string{"A", "AAAA"}
+	}
+}
+
+// order filters addrs to the families usable with the policy, and sorts them in the order it prefers.
+func (f AddressFamily) order(addrs []string) []string {
+	var v4, v6 []string
+	for _, addr := range addrs {
+		ip := net.ParseIP(addr)
+		switch {
+		case ip == nil:
+			continue
+		case ip.To4() != nil:
+			v4 = append(v4, addr)
+		default:
+			v6 = append(v6, addr)
+		}
+	}
+
+	switch f {
+	case IPv4Only:
+		return v4
+	case IPv6Only:
+		return v6
+	case PreferIPv6:
+		return append(v6, v4...)
+	case HappyEyeballs:
+		var ordered []string
+		for i := 0; i < len(v4) || i < len(v6); i++ {
+			if i < len(v6) {
+				ordered = append(ordered, v6[i])
+			}
+			if i < len(v4) {
+				ordered = append(ordered, v4[i])
+			}
+		}
+		return ordered
+	default:
+		return append(v4, v6...)
+	}
+}
@@ -0,0 +1,80 @@
+package bottin
+
+import (
+	"context"
+	"sync"
+)
+
+// flightGroup deduplicates the concurrent resolutions of the same name|type key: the first caller
+// starts the resolution, and the callers arriving while it runs share its result.
+type flightGroup struct {
+	calls map[string]*flight
+	waits map[string]string // Key of the flight each resolution path is waiting for, by the key it resolves.
+	mutex sync.Mutex
+}
+
+// flight is an in-flight resolution.
+type flight struct {
+	done chan struct{}
+	rrs  RRs
+	err  error
+}
+
+func newFlightGroup() *flightGroup {
+	return &flightGroup{
+		calls: make(map[string]*flight),
+		waits: make(map[string]string),
+	}
+}
+
+// do returns the result of fn, run once for all the concurrent callers with the same key.
+// fn runs detached from the cancellation and deadline of the callers, so that one caller giving up
+// doesn't fail the others, and each caller waits within its own ctx. The group sets no deadline of
+// its own: every fn must bind one, and stop when the resolver is closed, see BottinResolver.flight.
+// Joining a flight that waits, directly or not, for the resolution path of ctx would never complete,
+// so it fails with ErrMaxRecursion like other dependency loops.
+func (fg *flightGroup) do(ctx context.Context, key string, fn func(context.Context) (RRs, error)) (RRs, error) {
+	fg.mutex.Lock()
+	f, found := fg.calls[key]
+	if found {
+		for k, ok := key, true; ok; k, ok = fg.waits[k] {
+			if isPending(ctx, k) {
+				fg.mutex.Unlock()
+				return RRs{}, ErrMaxRecursion
+			}
+		}
+	} else {
+		f = &flight{done: make(chan struct{})}
+		fg.calls[key] = f
+		go fg.run(ctx, key, f, fn)
+	}
+	head, _ := ctx.Value(pendingKey{}).(*pending)
+	if head != nil {
+		fg.waits[head.key] = key
+	}
+	fg.mutex.Unlock()
+
+	defer func() {
+		if head != nil {
+			fg.mutex.Lock()
+			delete(fg.waits, head.key)
+			fg.mutex.Unlock()
+		}
+	}()
+	select {
+	case <-f.done:
+		return f.rrs, f.err
+	case <-ctx.Done():
+		return RRs{}, ctx.Err()
+	}
+}
+
+// run runs fn for the flight f, and hands its result to the callers.
+func (fg *flightGroup) run(ctx context.Context, key string, f *flight, fn func(context.Context) (RRs, error)) {
+	f.rrs, f.err = fn(context.WithoutCancel(ctx))
+
+	fg.mutex.Lock()
+	delete(fg.calls, key)
+	fg.mutex.Unlock()
+	close(f.done)
+}
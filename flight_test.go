@@ -0,0 +1,101 @@
+package bottin
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nbio/st"
+)
+
+func TestFlightsDedup(t *testing.T) {
+	n := newTestNetwork()
+	google := n.Server("216.239.32.10")
+	google.RTT = 50 * time.Millisecond
+	r := NewResolver(WithExchanger(n))
+
+	results := make([]RRs, 100)
+	errs := make([]error, len(results))
+	var wg sync.WaitGroup
+	for i := range results {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[i], errs[i] = r.ResolveErr("google.com", "A")
+		}()
+	}
+	wg.Wait()
+
+	for i := range results {
+		st.Expect(t, errs[i], nil)
+		st.Expect(t, results[i], results[0])
+	}
+	st.Expect(t, count(results[0].AnswerRRs, func(rr RR) bool { return rr.Type == "A" }) >= 1, true)
+	st.Expect(t, google.Queries(), 1)
+}
+
+func TestFlightsCancel(t *testing.T) {
+	n := newTestNetwork()
+	n.Server("216.239.32.10").RTT = 100 * time.Millisecond
+	r := NewResolver(WithExchanger(n))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errc := make(chan error, 1)
+	go func() {
+		_, err := r.ResolveCtx(ctx, "google.com", "A")
+		errc <- err
+	}()
+	time.Sleep(20 * time.Millisecond)
+	cancel()
+	st.Expect(t, <-errc, context.Canceled)
+
+	// The resolution started by the cancelled caller carries on for the other callers.
+	rrs, err := r.ResolveErr("google.com", "A")
+	st.Expect(t, err, nil)
+	st.Expect(t, count(rrs.AnswerRRs, func(rr RR) bool { return rr.Type == "A" }) >= 1, true)
+}
+
+func TestFlightsCycle(t *testing.T) {
+	fg := newFlightGroup()
+	started := make(chan struct{})
+	release := make(chan struct{})
+	go fg.do(context.Background(), "a.|A", func(ctx context.Context) (RRs, error) {
+		ctx, _ = withPending(ctx, "a.|A")
+		close(started)
+		return fg.do(ctx, "b.|A", func(context.Context) (RRs, error) {
+			<-release
+			return RRs{}, nil
+		})
+	})
+	<-started
+	time.Sleep(10 * time.Millisecond) // Let a.|A wait for b.|A
+
+	// The resolution of b.|A needing a.|A would wait for itself.
+	ctx, _ := withPending(context.Background(), "b.|A")
+	_, err := fg.do(ctx, "a.|A", nil)
+	st.Expect(t, err, ErrMaxRecursion)
+	close(release)
+}
+
+func TestFlightsDeadline(t *testing.T) {
+	n := newTestNetwork()
+	n.Server("216.239.32.10").RTT = 200 * time.Millisecond
+	r := NewResolver(WithExchanger(n))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	errc := make(chan error, 1)
+	go func() {
+		_, err := r.ResolveCtx(ctx, "google.com", "A")
+		errc <- err
+	}()
+	time.Sleep(20 * time.Millisecond)
+
+	// A caller without a deadline joining the flight isn't bound by the deadline of the first one.
+	rrs, err := r.ResolveCtx(context.Background(), "google.com", "A")
+	st.Expect(t, err, nil)
+	st.Expect(t, count(rrs.AnswerRRs, func(rr RR) bool { return rr.Type == "A" }) >= 1, true)
+	st.Expect(t, <-errc, ErrTimeout)
+	st.Expect(t, n.Server("216.239.32.10").Queries(), 1)
+}
@@ -0,0 +1,233 @@
+package bottin
+
+import (
+	"testing"
+	"time"
+
+	"github.com/kakwa/bottin/bottintest"
+	"github.com/nbio/st"
+)
+
+// The hierarchy served on loopback sockets by newTestHierarchy, under a private "test." TLD.
+const (
+	hierRootZone = `
+.                   86400 IN SOA a.root.test. hostmaster.root.test. 1 1800 900 604800 86400
+.                   86400 IN NS  a.root.test.
+.                   86400 IN NS  b.root.test.
+test.               86400 IN NS  ns.test.
+a.root.test.        86400 IN A   192.0.2.1
+b.root.test.        86400 IN A   192.0.2.2
+ns.test.            86400 IN A   192.0.2.10
+`
+	hierTestZone = `
+test.               3600  IN SOA ns.test. hostmaster.test. 1 1800 900 604800 300
+test.               3600  IN NS  ns.test.
+ns.test.            3600  IN A   192.0.2.10
+example.test.       3600  IN NS  ns1.example.test.
+ns1.example.test.   3600  IN A   192.0.2.20
+glueless.test.      3600  IN NS  ns1.example.test.
+lame.test.          3600  IN NS  ns1.lame.test.
+lame.test.          3600  IN NS  ns2.lame.test.
+ns1.lame.test.      3600  IN A   192.0.2.30
+ns2.lame.test.      3600  IN A   192.0.2.31
+big.test.           3600  IN NS  ns1.big.test.
+ns1.big.test.       3600  IN A   192.0.2.40
+dead.test.          3600  IN NS  ns1.dead.test.
+ns1.dead.test.      3600  IN A   192.0.2.50
+slow.test.          3600  IN NS  ns1.slow.test.
+slow.test.          3600  IN NS  ns2.slow.test.
+ns1.slow.test.      3600  IN A   192.0.2.50
+ns2.slow.test.      3600  IN A   192.0.2.51
+cycle1.test.        3600  IN NS  ns.cycle2.test.
+cycle2.test.        3600  IN NS  ns.cycle1.test.
+noaddr.test.        3600  IN NS  nowhere.example.test.
+`
+	hierExampleZone = `
+example.test.       3600  IN SOA ns1.example.test. hostmaster.example.test. 1 1800 900 604800 300
+example.test.       3600  IN NS  ns1.example.test.
+ns1.example.test.   3600  IN A   192.0.2.20
+www.example.test.   3600  IN A   198.51.100.1
+alias.example.test. 3600  IN CNAME www.glueless.test.
+dname.example.test. 3600  IN DNAME glueless.test.
+loop.example.test.  3600  IN CNAME loop.glueless.test.
+chain0.example.test. 3600  IN CNAME chain1.glueless.test.
+chain2.example.test. 3600  IN CNAME chain3.glueless.test.
+chain4.example.test. 3600  IN CNAME chain5.glueless.test.
+chain6.example.test. 3600  IN CNAME chain7.glueless.test.
+chain8.example.test. 3600  IN CNAME chain9.glueless.test.
+`
+	hierGluelessZone = `
+glueless.test.      3600  IN SOA ns1.example.test. hostmaster.example.test. 1 1800 900 604800 300
+glueless.test.      3600  IN NS  ns1.example.test.
+www.glueless.test.  3600  IN A   198.51.100.2
+loop.glueless.test. 3600  IN CNAME loop.example.test.
+chain1.glueless.test. 3600  IN CNAME chain2.example.test.
+chain3.glueless.test. 3600  IN CNAME chain4.example.test.
+chain5.glueless.test. 3600  IN CNAME chain6.example.test.
+chain7.glueless.test. 3600  IN CNAME chain8.example.test.
+chain9.glueless.test. 3600  IN CNAME chain10.example.test.
+`
+	hierLameZone = `
+lame.test.          3600  IN SOA ns2.lame.test. hostmaster.lame.test. 1 1800 900 604800 300
+lame.test.          3600  IN NS  ns1.lame.test.
+lame.test.          3600  IN NS  ns2.lame.test.
+www.lame.test.      3600  IN A   198.51.100.3
+`
+	hierBigZone = `
+big.test.           3600  IN SOA ns1.big.test. hostmaster.big.test. 1 1800 900 604800 300
+big.test.           3600  IN NS  ns1.big.test.
+www.big.test.       3600  IN A   198.51.100.4
+`
+	hierDeadZone = `
+dead.test.          3600  IN SOA ns1.dead.test. hostmaster.dead.test. 1 1800 900 604800 300
+dead.test.          3600  IN NS  ns1.dead.test.
+www.dead.test.      3600  IN A   198.51.100.5
+`
+	hierSlowZone = `
+slow.test.          3600  IN SOA ns2.slow.test. hostmaster.slow.test. 1 1800 900 604800 300
+slow.test.          3600  IN NS  ns1.slow.test.
+slow.test.          3600  IN NS  ns2.slow.test.
+www.slow.test.      3600  IN A   198.51.100.6
+`
+)
+
+// newTestHierarchy starts the test hierarchy on loopback sockets, closed at the end of the test.
+func newTestHierarchy(t *testing.T) *bottintest.Hierarchy {
+	h := bottintest.NewHierarchy()
+	t.Cleanup(func() { h.Close() })
+
+	start := func(zones []string, configure func(*bottintest.Server), addrs ...string) {
+		srv, err := bottintest.NewServer(zones...)
+		st.Assert(t, err, nil)
+		if configure != nil {
+			configure(srv) // Before serving, the handlers read the settings concurrently
+		}
+		st.Assert(t, h.Start(srv, addrs...), nil)
+	}
+	start([]string{hierRootZone}, nil, "192.0.2.1", "192.0.2.2")
+	start([]string{hierTestZone}, nil, "192.0.2.10")
+	start([]string{hierExampleZone, hierGluelessZone}, nil, "192.0.2.20")
+	start([]string{hierLameZone}, func(srv *bottintest.Server) { srv.Refuse = true }, "192.0.2.30")
+	start([]string{hierLameZone}, nil, "192.0.2.31")
+	start([]string{hierBigZone}, func(srv *bottintest.Server) { srv.Truncate = true }, "192.0.2.40")
+	start([]string{hierDeadZone, hierSlowZone}, func(srv *bottintest.Server) { srv.Drop = true }, "192.0.2.50")
+	start([]string{hierSlowZone}, nil, "192.0.2.51")
+	return h
+}
+
+// newHierarchyResolver returns a resolver of the hierarchy h.
+func newHierarchyResolver(t *testing.T, h *bottintest.Hierarchy, options ...Option) *BottinResolver {
+	hints, err := h.RootHints()
+	st.Assert(t, err, nil)
+	return NewResolver(append([]Option{WithExchanger(h), WithRootHints(hints)}, options...)...)
+}
+
+func TestHierarchyRootHints(t *testing.T) {
+	h := newTestHierarchy(t)
+	r := newHierarchyResolver(t, h)
+	rrs, ok := r.root.Get(".|NS")
+	st.Expect(t, ok, true)
+	st.Expect(t, len(rrs), 2)
+	rrs, ok = r.root.Get("a.root.test.|A")
+	st.Expect(t, ok, true)
+	st.Expect(t, len(rrs), 1)
+	st.Expect(t, rrs[0].Value, "192.0.2.1")
+	_, ok = r.root.Get("a.root-servers.net.|A")
+	st.Expect(t, ok, false)
+}
+
+func TestHierarchyReferral(t *testing.T) {
+	r := newHierarchyResolver(t, newTestHierarchy(t))
+	rrs, err := r.ResolveErr("www.example.test", "A")
+	st.Expect(t, err, nil)
+	st.Expect(t, len(rrs.AnswerRRs), 1)
+	st.Expect(t, rrs.AnswerRRs[0].Value, "198.51.100.1")
+}
+
+func TestHierarchyGlueless(t *testing.T) {
+	r := newHierarchyResolver(t, newTestHierarchy(t))
+	rrs, err := r.ResolveErr("www.glueless.test", "A")
+	st.Expect(t, err, nil)
+	st.Expect(t, count(rrs.AnswerRRs, func(rr RR) bool { return rr.Value == "198.51.100.2" }), 1)
+}
+
+func TestHierarchyGluelessCycle(t *testing.T) {
+	r := newHierarchyResolver(t, newTestHierarchy(t))
+	_, err := r.ResolveErr("www.cycle1.test", "A")
+	st.Expect(t, err, ErrMaxRecursion)
+}
+
+func TestHierarchyNoNameserverAddress(t *testing.T) {
+	r := newHierarchyResolver(t, newTestHierarchy(t))
+	_, err := r.ResolveErr("www.noaddr.test", "A")
+	st.Expect(t, err, ErrNoARecords)
+}
+
+func TestHierarchyCNAME(t *testing.T) {
+	r := newHierarchyResolver(t, newTestHierarchy(t))
+	rrs, err := r.ResolveErr("alias.example.test", "A")
+	st.Expect(t, err, nil)
+	st.Expect(t, count(rrs.AnswerRRs, func(rr RR) bool { return rr.Type == "CNAME" && rr.Value == "www.glueless.test." }), 1)
+	st.Expect(t, count(rrs.AnswerRRs, func(rr RR) bool { return rr.Type == "A" && rr.Value == "198.51.100.2" }), 1)
+}
+
+func TestHierarchyDNAME(t *testing.T) {
+	r := newHierarchyResolver(t, newTestHierarchy(t))
+	rrs, err := r.ResolveErr("www.dname.example.test", "A")
+	st.Expect(t, err, nil)
+	st.Expect(t, count(rrs.AnswerRRs, func(rr RR) bool { return rr.Type == "DNAME" && rr.Value == "glueless.test." }), 1)
+	st.Expect(t, count(rrs.AnswerRRs, func(rr RR) bool { return rr.Type == "CNAME" && rr.Value == "www.glueless.test." }), 1)
+	st.Expect(t, count(rrs.AnswerRRs, func(rr RR) bool { return rr.Type == "A" && rr.Value == "198.51.100.2" }), 1)
+}
+
+func TestHierarchyCNAMELoop(t *testing.T) {
+	r := newHierarchyResolver(t, newTestHierarchy(t))
+	_, err := r.ResolveErr("loop.example.test", "A")
+	st.Expect(t, err, ErrMaxCNAMEs)
+}
+
+func TestHierarchyCNAMEChain(t *testing.T) {
+	r := newHierarchyResolver(t, newTestHierarchy(t))
+	// Ten links across two zones, more than MaxCNAMEs restarts.
+	_, err := r.ResolveErr("chain0.example.test", "A")
+	st.Expect(t, err, ErrMaxCNAMEs)
+}
+
+func TestHierarchyNXDOMAIN(t *testing.T) {
+	r := newHierarchyResolver(t, newTestHierarchy(t))
+	_, err := r.ResolveErr("missing.example.test", "A")
+	st.Expect(t, err, NXDOMAIN)
+	_, err = r.ResolveErr("missing.test", "A")
+	st.Expect(t, err, NXDOMAIN)
+}
+
+func TestHierarchyLame(t *testing.T) {
+	r := newHierarchyResolver(t, newTestHierarchy(t))
+	rrs, err := r.ResolveErr("www.lame.test", "A")
+	st.Expect(t, err, nil)
+	st.Expect(t, count(rrs.AnswerRRs, func(rr RR) bool { return rr.Value == "198.51.100.3" }), 1)
+}
+
+func TestHierarchyTruncated(t *testing.T) {
+	h := newTestHierarchy(t)
+	r := newHierarchyResolver(t, h, WithTCPRetry())
+	rrs, err := r.ResolveErr("www.big.test", "A")
+	st.Expect(t, err, nil)
+	st.Expect(t, count(rrs.AnswerRRs, func(rr RR) bool { return rr.Value == "198.51.100.4" }), 1)
+}
+
+func TestHierarchyTimeout(t *testing.T) {
+	r := newHierarchyResolver(t, newTestHierarchy(t), WithTimeout(500*time.Millisecond))
+	start := time.Now()
+	_, err := r.ResolveErr("www.dead.test", "A")
+	st.Expect(t, err, ErrTimeout)
+	st.Expect(t, time.Since(start) < 2*time.Second, true)
+}
+
+func TestHierarchyTimeoutHedging(t *testing.T) {
+	r := newHierarchyResolver(t, newTestHierarchy(t), WithHedging())
+	r.infra.rtt("192.0.2.51", time.Second) // Query the dead server first
+	rrs, err := r.ResolveErr("www.slow.test", "A")
+	st.Expect(t, err, nil)
+	st.Expect(t, count(rrs.AnswerRRs, func(rr RR) bool { return rr.Value == "198.51.100.6" }), 1)
+}
@@ -0,0 +1,140 @@
+package bottin
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	infraTTL        = 15 * time.Minute  // Time after which what was learned about a nameserver is forgotten.
+	maxSRTT         = 120 * time.Second // Cap of the smoothed RTT after timeout penalties.
+	maxEDNSTimeouts = 3                 // EDNS0 queries timing out in a row before plain DNS is tried.
+)
+
+// infraCache holds what was learned about the behavior of nameservers, keyed by IP address,
+// like BIND's SRTT or Unbound's infra cache.
+type infraCache struct {
+	servers map[string]*serverInfo
+	clock   Clock
+	mutex   sync.Mutex
+}
+
+// serverInfo is the infrastructure cache entry of a nameserver.
+type serverInfo struct {
+	noEDNS       time.Time     // When the server was found not to handle EDNS0, zero if it does.
+	no0x20       time.Time     // When the server was found not to preserve the case of query names.
+	ednsTimeouts int           // EDNS0 queries that timed out in a row.
+	srtt         time.Duration // Smoothed round trip time, 0 if the server was never queried.
+	updated      time.Time     // Last time srtt was updated.
+}
+
+func newInfraCache(clock Clock) *infraCache {
+	return &infraCache{
+		servers: make(map[string]*serverInfo),
+		clock:   clock,
+	}
+}
+
+// get returns a copy of the entry of the nameserver at addr.
+func (ic *infraCache) get(addr string) serverInfo {
+	ic.mutex.Lock()
+	defer ic.mutex.Unlock()
+	if info, found := ic.servers[addr]; found {
+		return *info
+	}
+	return serverInfo{}
+}
+
+// update applies f to the entry of the nameserver at addr, creating it if needed.
+func (ic *infraCache) update(addr string, f func(*serverInfo)) {
+	ic.mutex.Lock()
+	defer ic.mutex.Unlock()
+	info, found := ic.servers[addr]
+	if !found {
+		info = &serverInfo{}
+		ic.servers[addr] = info
+	}
+	f(info)
+}
+
+// noEDNS reports whether the nameserver at addr was recently found not to handle EDNS0.
+func (ic *infraCache) noEDNS(addr string) bool {
+	return ic.recent(ic.get(addr).noEDNS)
+}
+
+// no0x20 reports whether the nameserver at addr was recently found not to preserve the case of
+// query names.
+func (ic *infraCache) no0x20(addr string) bool {
+	return ic.recent(ic.get(addr).no0x20)
+}
+
+// recent reports whether something learned at t is still remembered.
+func (ic *infraCache) recent(t time.Time) bool {
+	return !t.IsZero() && ic.clock.Now().Sub(t) <= infraTTL
+}
+
+// ednsTimeout counts a timed out EDNS0 query to the nameserver at addr, and reports whether plain
+// DNS should be tried: only after maxEDNSTimeouts in a row, as a single loss says nothing of EDNS0.
+func (ic *infraCache) ednsTimeout(addr string) bool {
+	fallback := false
+	ic.update(addr, func(info *serverInfo) {
+		info.ednsTimeouts++
+		fallback = info.ednsTimeouts >= maxEDNSTimeouts
+	})
+	return fallback
+}
+
+// ednsAnswered records that the nameserver at addr answered an EDNS0 query.
+func (ic *infraCache) ednsAnswered(addr string) {
+	ic.update(addr, func(info *serverInfo) { info.ednsTimeouts = 0 })
+}
+
+// srtt returns the smoothed RTT of the nameserver at addr.
+// Servers never queried, or not queried recently, start at TypicalResponseTime.
+func (ic *infraCache) srtt(addr string) time.Duration {
+	info := ic.get(addr)
+	if info.srtt == 0 || ic.clock.Now().Sub(info.updated) > infraTTL {
+		return TypicalResponseTime
+	}
+	return info.srtt
+}
+
+// rtt folds a measured round trip time to the nameserver at addr into its smoothed RTT.
+func (ic *infraCache) rtt(addr string, rtt time.Duration) {
+	ic.update(addr, func(info *serverInfo) {
+		if info.srtt == 0 || ic.clock.Now().Sub(info.updated) > infraTTL {
+			info.srtt = rtt
+		} else {
+			info.srtt = (7*info.srtt + 3*rtt) / 10
+		}
+		info.updated = ic.clock.Now()
+	})
+}
+
+// timeout applies a backoff penalty to the nameserver at addr, doubling its smoothed RTT.
+func (ic *infraCache) timeout(addr string) {
+	ic.update(addr, func(info *serverInfo) {
+		if info.srtt == 0 || ic.clock.Now().Sub(info.updated) > infraTTL {
+			info.srtt = TypicalResponseTime
+		}
+		info.srtt *= 2
+		if info.srtt > maxSRTT {
+			info.srtt = maxSRTT
+		}
+		info.updated = ic.clock.Now()
+	})
+}
+
+// sort returns a copy of addrs sorted by smoothed RTT, keeping the original order between equals.
+func (ic *infraCache) sort(addrs []string) []string {
+	srtts := make(map[string]time.Duration, len(addrs))
+	for _, addr := range addrs {
+		srtts[addr] = ic.srtt(addr)
+	}
+	sorted := append([]string(nil), addrs...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return srtts[sorted[i]] < srtts[sorted[j]]
+	})
+	return sorted
+}
@@ -0,0 +1,83 @@
+package bottin
+
+import (
+	"testing"
+	"time"
+
+	"github.com/kakwa/bottin/bottintest"
+	"github.com/nbio/st"
+)
+
+func TestInfraCacheSRTT(t *testing.T) {
+	ic := newInfraCache(systemClock{})
+	st.Expect(t, ic.srtt("192.0.2.1"), TypicalResponseTime)
+
+	ic.rtt("192.0.2.1", 50*time.Millisecond)
+	st.Expect(t, ic.srtt("192.0.2.1"), 50*time.Millisecond)
+	ic.rtt("192.0.2.1", 150*time.Millisecond)
+	st.Expect(t, ic.srtt("192.0.2.1"), 80*time.Millisecond)
+
+	ic.timeout("192.0.2.1")
+	st.Expect(t, ic.srtt("192.0.2.1"), 160*time.Millisecond)
+	for i := 0; i < 20; i++ {
+		ic.timeout("192.0.2.1")
+	}
+	st.Expect(t, ic.srtt("192.0.2.1"), maxSRTT)
+}
+
+func TestInfraCacheSort(t *testing.T) {
+	ic := newInfraCache(systemClock{})
+	ic.rtt("192.0.2.1", 300*time.Millisecond)
+	ic.rtt("192.0.2.2", 10*time.Millisecond)
+	addrs := []string{"192.0.2.1", "192.0.2.3", "192.0.2.2", "192.0.2.4"}
+	st.Expect(t, ic.sort(addrs), []string{"192.0.2.2", "192.0.2.3", "192.0.2.4", "192.0.2.1"})
+	st.Expect(t, addrs[0], "192.0.2.1")
+}
+
+func TestWithHedging(t *testing.T) {
+	r := NewResolver(WithHedging())
+	st.Expect(t, r.hedge, true)
+	r.infra.rtt("192.0.2.1", 30*time.Millisecond)
+	st.Expect(t, r.stagger("192.0.2.1"), 30*time.Millisecond)
+	st.Expect(t, NewResolver().stagger("192.0.2.1"), time.Duration(0))
+}
+
+func TestInfraCacheEDNSTimeouts(t *testing.T) {
+	ic := newInfraCache(systemClock{})
+	for i := 1; i < maxEDNSTimeouts; i++ {
+		st.Expect(t, ic.ednsTimeout("192.0.2.1"), false)
+	}
+	ic.ednsAnswered("192.0.2.1")
+	for i := 1; i < maxEDNSTimeouts; i++ {
+		st.Expect(t, ic.ednsTimeout("192.0.2.1"), false)
+	}
+	st.Expect(t, ic.ednsTimeout("192.0.2.1"), true)
+}
+
+func TestEDNSFallback(t *testing.T) {
+	clock := bottintest.NewClock(time.Now())
+	n := newTestNetwork()
+	google := []string{"216.239.32.10", "216.239.34.10", "216.239.36.10", "216.239.38.10"}
+	for _, addr := range google {
+		n.Server(addr).NoEDNS = true
+	}
+	r := NewResolver(WithExchanger(n), WithClock(clock), WithCache(0))
+
+	rrs, err := r.ResolveErr("google.com", "A")
+	st.Expect(t, err, nil)
+	st.Expect(t, count(rrs.AnswerRRs, func(rr RR) bool { return rr.Type == "A" }), 1)
+	noEDNS := func() (servers []string) {
+		for _, addr := range google {
+			if r.infra.noEDNS(addr) {
+				servers = append(servers, addr)
+			}
+		}
+		return servers
+	}
+	st.Assert(t, len(noEDNS()), 1)
+	st.Expect(t, r.infra.noEDNS("192.5.6.30"), false)
+
+	// What was learned is forgotten with the rest of the infrastructure cache.
+	clock.Advance(infraTTL + time.Second)
+	st.Expect(t, len(noEDNS()), 0)
+}
@@ -0,0 +1,38 @@
+package bottin
+
+import (
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/nbio/st"
+)
+
+func TestResolverClose(t *testing.T) {
+	before := runtime.NumGoroutine()
+	for i := 0; i < 50; i++ {
+		r := NewResolver(WithExpiry(), WithPrefetch(0.1, 1))
+		st.Expect(t, r.Close(), nil)
+	}
+	st.Expect(t, runtime.NumGoroutine() <= before, true)
+}
+
+func TestResolverCloseInFlight(t *testing.T) {
+	n := newTestNetwork()
+	n.Server("216.239.32.10").RTT = time.Second
+	r := NewResolver(WithExchanger(n))
+
+	errc := make(chan error, 1)
+	go func() {
+		_, err := r.ResolveErr("google.com", "A")
+		errc <- err
+	}()
+	time.Sleep(20 * time.Millisecond)
+	start := time.Now()
+	st.Expect(t, r.Close(), nil)
+	st.Expect(t, <-errc, ErrClosed)
+	st.Expect(t, time.Since(start) < 500*time.Millisecond, true)
+
+	_, err := r.ResolveErr("google.com", "A")
+	st.Expect(t, err, ErrClosed)
+}
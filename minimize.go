@@ -0,0 +1,32 @@
+package bottin
+
+import (
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// QNameMinimization is a QNAME minimisation mode, which only sends the nameservers of each zone
+// the labels of the query name they need to find the next zone cut (RFC 9156).
+type QNameMinimization int
+
+const (
+	MinimizeOff     QNameMinimization = iota // Send the full query name to every nameserver.
+	MinimizeRelaxed                          // Minimise, sending the full query name where minimised queries fail.
+	MinimizeStrict                           // Minimise, failing the resolution where minimised queries fail.
+)
+
+// minimal returns the name sent to the nameservers of a zone in place of qname, one label longer than
+// known, an ancestor of qname at or below the zone. It returns "" when qname itself is sent: once
+// qname is reached, or when the name would have more labels than the configured maximum.
+func (br *BottinResolver) minimal(known, qname string) string {
+	if br.minimize == MinimizeOff {
+		return ""
+	}
+	labels := dns.SplitDomainName(qname)
+	n := dns.CountLabel(known) + 1
+	if n >= len(labels) || (br.minimizeLabels > 0 && n > br.minimizeLabels) {
+		return ""
+	}
+	return toLowerFQDN(strings.Join(labels[len(labels)-n:], "."))
+}
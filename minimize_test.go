@@ -0,0 +1,96 @@
+package bottin
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/nbio/st"
+
+	"github.com/kakwa/bottin/bottintest"
+)
+
+// questions records the query names received by the servers at addrs.
+type questions struct {
+	names []string
+	mutex sync.Mutex
+}
+
+func recordQuestions(n *bottintest.Network, addrs ...string) *questions {
+	q := new(questions)
+	for _, addr := range addrs {
+		n.Server(addr).Mangle = func(resp *dns.Msg) {
+			q.mutex.Lock()
+			defer q.mutex.Unlock()
+			q.names = append(q.names, resp.Question[0].Name)
+		}
+	}
+	return q
+}
+
+func (q *questions) get() []string {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	return append([]string(nil), q.names...)
+}
+
+func TestQNameMinimization(t *testing.T) {
+	n := newTestNetwork()
+	root := recordQuestions(n, rootHintAddrs()...)
+	uk := recordQuestions(n, "156.154.100.3")
+	baz := recordQuestions(n, "192.0.2.53", "192.0.2.54")
+	r := NewResolver(WithExchanger(n), WithQNameMinimization(MinimizeStrict, 0))
+
+	rrs, err := r.ResolveErr("baz.co.uk", "MX")
+	st.Expect(t, err, nil)
+	st.Expect(t, count(rrs.AnswerRRs, func(rr RR) bool { return rr.Type == "MX" }), 1)
+	st.Expect(t, root.get(), []string{"uk."})
+	st.Expect(t, uk.get(), []string{"co.uk.", "baz.co.uk."}) // co.uk. is an empty non-terminal.
+	st.Expect(t, baz.get(), []string{"baz.co.uk."})
+}
+
+func TestQNameMinimizationNXDOMAIN(t *testing.T) {
+	n := newTestNetwork()
+	uk := recordQuestions(n, "156.154.100.3")
+	r := NewResolver(WithExchanger(n), WithQNameMinimization(MinimizeStrict, 0))
+
+	_, err := r.ResolveErr("www.nonexistent.co.uk", "A")
+	st.Expect(t, err, NXDOMAIN)
+	st.Expect(t, uk.get(), []string{"co.uk.", "nonexistent.co.uk."})
+	_, found := r.cache.Get(nxdomainKey("www.nonexistent.co.uk."))
+	st.Expect(t, found, true)
+}
+
+func TestQNameMinimizationFallback(t *testing.T) {
+	// The uk nameserver wrongly denies the empty non-terminal co.uk.
+	broken := func(resp *dns.Msg) {
+		if resp.Question[0].Name == "co.uk." {
+			resp.Rcode = dns.RcodeNameError
+		}
+	}
+
+	n := newTestNetwork()
+	n.Server("156.154.100.3").Mangle = broken
+	r := NewResolver(WithExchanger(n), WithQNameMinimization(MinimizeRelaxed, 0))
+	rrs, err := r.ResolveErr("baz.co.uk", "MX")
+	st.Expect(t, err, nil)
+	st.Expect(t, count(rrs.AnswerRRs, func(rr RR) bool { return rr.Type == "MX" }), 1)
+
+	n = newTestNetwork()
+	n.Server("156.154.100.3").Mangle = broken
+	r = NewResolver(WithExchanger(n), WithQNameMinimization(MinimizeStrict, 0))
+	_, err = r.ResolveErr("baz.co.uk", "MX")
+	st.Expect(t, err, NXDOMAIN)
+}
+
+func TestQNameMinimizationMaxLabels(t *testing.T) {
+	n := newTestNetwork()
+	com := recordQuestions(n, "192.5.6.30", "192.33.14.30")
+	google := recordQuestions(n, "216.239.32.10", "216.239.34.10", "216.239.36.10", "216.239.38.10")
+	r := NewResolver(WithExchanger(n), WithQNameMinimization(MinimizeStrict, 2))
+
+	_, err := r.ResolveErr("a.b.c.google.com", "A")
+	st.Expect(t, err, NXDOMAIN)
+	st.Expect(t, com.get(), []string{"google.com."})
+	st.Expect(t, google.get(), []string{"a.b.c.google.com."})
+}
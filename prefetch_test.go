@@ -0,0 +1,66 @@
+package bottin
+
+import (
+	"testing"
+	"time"
+
+	"github.com/kakwa/bottin/bottintest"
+	"github.com/nbio/st"
+)
+
+func TestPrefetch(t *testing.T) {
+	n := newTestNetwork()
+	clock := bottintest.NewClock(time.Now())
+	r := NewResolver(WithExchanger(n), WithClock(clock), WithExpiry(), WithPrefetch(0.5, 2))
+	_, err := r.ResolveErr("google.com", "A") // Cache the delegation of google.com.
+	st.Expect(t, err, nil)
+	r.cache.Set("google.com.|A", []RR{{Name: "google.com.", Type: "A", Value: "192.0.2.14", TTL: time.Minute}})
+	queries := n.Server("216.239.32.10").Queries()
+
+	clock.Advance(40 * time.Second)
+	for i := 0; i < 3; i++ {
+		rrs, err := r.ResolveErr("google.com", "A")
+		st.Expect(t, err, nil)
+		st.Expect(t, rrs.AnswerRRs[0].Value, "192.0.2.14") // Answered from the cache right away.
+	}
+
+	var rrs []RR
+	for start := time.Now(); time.Since(start) < time.Second; time.Sleep(time.Millisecond) {
+		if rrs, _ = r.cache.Get("google.com.|A"); rrs[0].Value != "192.0.2.14" {
+			break // Refreshed by the prefetch.
+		}
+	}
+	st.Expect(t, rrs[0].Value, "142.250.72.14")
+	st.Expect(t, rrs[0].TTL, 300*time.Second)
+	st.Expect(t, n.Server("216.239.32.10").Queries(), queries+1)
+}
+
+func TestPrefetchClose(t *testing.T) {
+	n := newTestNetwork()
+	clock := bottintest.NewClock(time.Now())
+	r := NewResolver(WithExchanger(n), WithClock(clock), WithExpiry(), WithPrefetch(0.5, 1), WithTimeout(time.Minute))
+	_, err := r.ResolveErr("google.com", "A")
+	st.Expect(t, err, nil)
+	google := n.Server("216.239.32.10")
+	google.Drop = true
+	queries := google.Queries()
+
+	clock.Advance(200 * time.Second)
+	_, err = r.ResolveErr("google.com", "A")
+	st.Expect(t, err, nil)
+	for google.Queries() == queries {
+		time.Sleep(time.Millisecond) // Until the prefetch waits for the dropped query.
+	}
+
+	// Closing the resolver stops the prefetch, which would otherwise wait for its timeout.
+	st.Expect(t, r.Close(), nil)
+	inflight := func() int {
+		r.flights.mutex.Lock()
+		defer r.flights.mutex.Unlock()
+		return len(r.flights.calls)
+	}
+	for start := time.Now(); inflight() > 0 && time.Since(start) < time.Second; {
+		time.Sleep(time.Millisecond)
+	}
+	st.Expect(t, inflight(), 0)
+}
@@ -5,6 +5,11 @@ import (
 	"errors"
 	"fmt"
 	"github.com/miekg/dns"
+	"log/slog"
+	"net"
+	"sort"
+	"strings"
+	"sync"
 	"time"
 )
 
@@ -14,7 +19,7 @@ type RR struct {
 	Type   string        `json:"type"`
 	Value  string        `json:"value"`
 	TTL    time.Duration `json:"ttl"`
-	Expiry time.Time     `json:"expiry"`
+	Expiry time.Time     `json:"expiry"` // Zero for records that don't expire.
 }
 
 func (rr *RR) Key() string {
@@ -25,6 +30,7 @@ type RRs struct {
 	AnswerRRs     []RR
 	AuthorityRRs  []RR
 	AdditionalRRs []RR
+	Security      SecurityStatus // DNSSEC status of the records, Indeterminate unless validated.
 }
 
 type Resolver interface {
@@ -35,41 +41,111 @@ type Resolver interface {
 }
 
 type BottinResolver struct {
-	root   *Cache
-	cache  *Cache
-	client *dns.Client
+	config
+	root    *Cache
+	cache   *Cache
+	infra   *infraCache
+	flights *flightGroup
+	keys    *keyCache              // DNSSEC status of the zones, with their validated keys.
+	anchors map[string][]dns.RR    // DNSSEC trust anchors, by zone.
+	tracked map[string][]anchorKey // Keys of the zones with a trust anchor, by zone, with WithTrustAnchorFile.
+
+	anchorMutex sync.RWMutex // Guards anchors and tracked, updated by the RFC 5011 refreshes.
+
+	staleFailures map[string]time.Time // Time of the last failed refresh of stale entries, by name|type.
+	staleMutex    sync.Mutex           // Guards staleFailures.
+
+	lifetime context.Context    // Cancelled by Close.
+	stop     context.CancelFunc // Cancels lifetime.
+	workers  sync.WaitGroup     // Background goroutines, waited for by Close.
 }
 
-func New(cap int) *BottinResolver {
-	root := NewCache()
-	cache := NewCache()
+// config holds the settings filled in by the constructors and Option functions.
+type config struct {
+	capacity       int               // cache capacity, 0 for unbounded
+	dialer         *net.Dialer       // dialer used for outbound sockets, nil for the default one
+	timeout        time.Duration     // timeout of a resolution and of each query it sends
+	tcpRetry       bool              // retry truncated UDP responses over TCP
+	tcpZones       []string          // zones whose nameservers are always queried over TCP
+	tcpServers     []string          // nameserver IP addresses always queried over TCP
+	ednsSize       uint16            // advertised EDNS0 UDP buffer size, 0 to disable EDNS0
+	family         AddressFamily     // address families of the nameservers queried
+	hedge          bool              // query another nameserver when one exceeds its expected RTT
+	logger         *slog.Logger      // receives the resolution trace, nil to disable it
+	exchanger      Exchanger         // sends the upstream queries, nil for a ClientExchanger
+	rootHints      string            // root hints in the format of named.root, "" for the embedded ones
+	staleWindow    time.Duration     // how long expired records can be served, 0 to disable serve-stale
+	staleTimeout   time.Duration     // time after which stale records are served while resolving, 0 to wait
+	prefetch       float64           // fraction of the TTL left under which hit entries are refreshed, 0 to disable
+	prefetchHits   int               // number of hits an entry needs to be prefetched
+	cacheOptions   []CacheOption     // extra options of the cache, like its TTL policy
+	clock          Clock             // tells the time for the expiry of records
+	randomizeCase  bool              // randomize the case of query names (DNS 0x20)
+	minimize       QNameMinimization // QNAME minimisation mode
+	minimizeLabels int               // maximum number of labels of minimised query names, 0 for no maximum
+	dnssec         bool              // validate responses with DNSSEC, asking for the DNSSEC records
+	trustAnchors   string            // DS or DNSKEY trust anchors in zone-file format, "" for the embedded ones
+	anchorFile     string            // file of the trust anchors maintained with RFC 5011, "" to disable it
+	expire         bool              // honor the TTL of cached records
+}
 
-	res := BottinResolver{
-		cache: cache,
-		root:  root,
-	}
-	res.initRoot()
-	return &res
+func New(cap int) *BottinResolver {
+	return NewResolver(WithCache(cap))
 }
 
 func NewExpiring(cap int) *BottinResolver {
-	// FIXME
-	return New(cap)
+	return NewResolver(WithCache(cap), WithExpiry())
 }
 
 func NewExpiringWithTimeout(cap int, timeout time.Duration) *BottinResolver {
-	// FIXME
-	return New(cap)
+	return NewResolver(WithCache(cap), WithExpiry(), WithTimeout(timeout))
 }
 
 func NewResolver(options ...Option) *BottinResolver {
-	// FIXME
-	return New(42)
+	res := BottinResolver{
+		config: config{
+			timeout:  Timeout,
+			ednsSize: EDNSBufferSize,
+			clock:    systemClock{},
+		},
+	}
+	if DebugLogger != nil {
+		WithTraceWriter(DebugLogger)(&res)
+	}
+	for _, option := range options {
+		option(&res)
+	}
+	if res.exchanger == nil {
+		res.exchanger = &ClientExchanger{Dialer: res.dialer}
+	}
+	res.lifetime, res.stop = context.WithCancel(context.Background())
+	res.infra = newInfraCache(res.clock)
+	res.flights = newFlightGroup()
+	res.staleFailures = make(map[string]time.Time)
+	res.root = NewCache(WithCleanupInterval(0), WithCacheClock(res.clock)) // Root hints are pinned.
+	cacheOptions := []CacheOption{WithCapacity(res.capacity), WithStaleWindow(res.staleWindow), WithCacheClock(res.clock)}
+	if !res.expire {
+		cacheOptions = append(cacheOptions, WithoutExpiry())
+	}
+	if res.prefetch > 0 {
+		cacheOptions = append(cacheOptions, WithPrefetchFunc(res.prefetch, res.prefetchHits, res.refresh))
+	}
+	res.cache = NewCache(append(cacheOptions, res.cacheOptions...)...)
+	res.initRoot()
+	if res.dnssec {
+		res.keys = newKeyCache(res.clock)
+		res.initAnchors()
+		if res.anchorFile != "" {
+			res.loadAnchorFile()
+			res.workers.Add(1)
+			go res.maintainAnchors()
+		}
+	}
+	return &res
 }
 
 func NewWithTimeout(cap int, timeout time.Duration) *BottinResolver {
-	// FIXME
-	return New(cap)
+	return NewResolver(WithCache(cap), WithTimeout(timeout))
 }
 
 func (br *BottinResolver) Resolve(qname, qtype string) RRs {
@@ -78,80 +154,967 @@ func (br *BottinResolver) Resolve(qname, qtype string) RRs {
 }
 
 func (br *BottinResolver) ResolveCtx(ctx context.Context, qname, qtype string) (RRs, error) {
-	var err error
-	var nsRRs RRs
-	parentQname, isRoot := parent(qname)
-	if isRoot && qtype == "NS" {
-		c, _ := br.root.DumpJSON()
-		fmt.Printf("%s\n", c)
-		nsRRsNS, _ := br.root.Get(".|NS")
-		for _, rr := range nsRRsNS {
-			nsRRsA, _ := br.root.Get(rr.Value + "|A")
-			nsRRs.AnswerRRs = append(nsRRs.AnswerRRs, nsRRsA...)
-		}
-		// for _, rr := range nsRRsNS {
-		// 	nsRRsAAAA, _ := br.root.Get(rr.Value + "|AAAA")
-		// 	nsRRs.AnswerRRs = append(nsRRs.AnswerRRs, nsRRsAAAA...)
-		// }
-
-		return nsRRs, nil
+	ctx, release := br.bind(ctx)
+	defer release()
+	rrs, err := br.resolve(ctx, toLowerFQDN(qname), qtype, 0)
+	if err != nil && br.lifetime.Err() != nil {
+		return RRs{}, ErrClosed
+	}
+	return rrs, err
+}
+
+// Close stops the background work of the resolver, the cleanup of its cache and the prefetch of
+// its entries. The resolutions in progress fail with ErrClosed, and so do the next ones.
+func (br *BottinResolver) Close() error {
+	br.stop()
+	br.workers.Wait()
+	br.cache.Close()
+	return br.root.Close()
+}
+
+// bind returns a copy of ctx cancelled when the resolver is closed, and the function releasing it.
+func (br *BottinResolver) bind(ctx context.Context) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(ctx)
+	unregister := context.AfterFunc(br.lifetime, cancel)
+	return ctx, func() {
+		unregister()
+		cancel()
+	}
+}
+
+// resolve answers qname/qtype, restarting at the target of each CNAME or DNAME found on the way.
+// depth counts the nested resolutions (glueless nameserver addresses) leading to this one.
+func (br *BottinResolver) resolve(ctx context.Context, qname, qtype string, depth int) (RRs, error) {
+	if err := ctx.Err(); err != nil {
+		return RRs{}, err
+	}
+	if depth > MaxRecursion {
+		return RRs{}, ErrMaxRecursion
+	}
+
+	var answers []RR
+	security := Secure
+	name := qname
+	for hops := 0; ; hops++ {
+		results, err := br.resolveName(ctx, name, qtype, depth)
+		answers = append(answers, results.AnswerRRs...)
+		results.AnswerRRs = answers
+		// A chain is only as secure as its least secure link.
+		security = min(security, results.Security)
+		results.Security = security
+
+		_, target := chain(results.AnswerRRs, name)
+		if next, _ := chain(results.AnswerRRs, target); len(next) > 0 {
+			return RRs{}, ErrMaxCNAMEs // The chain loops back on itself.
+		}
+		if err != nil || target == name || wireType(qtype) == "CNAME" || has(results.AnswerRRs, target, wireType(qtype)) {
+			return br.result(qname, qtype, results), err
+		}
+		if hops >= MaxCNAMEs {
+			return RRs{}, ErrMaxCNAMEs
+		}
+		br.trace(ctx, "follow alias", slog.String("qname", name), slog.String("target", target))
+		name = target
+	}
+}
+
+// resolveName answers name/qtype from the cache, or iterates from the closest known zone cut.
+// A CNAME for name is returned in place of the records of type qtype.
+func (br *BottinResolver) resolveName(ctx context.Context, name, qtype string, depth int) (RRs, error) {
+	if recorder(ctx) != nil {
+		// Traced resolutions bypass the cache to show the whole delegation path.
+		rrs, err := br.iterate(ctx, name, qtype, depth)
+		return rrs, timedOut(ctx, err)
+	}
+	rrs, hit, err := br.cached(name, qtype, br.cache.Get)
+	br.traceCache(ctx, name, qtype, hit)
+	if hit != "" {
+		return rrs, err
+	}
+
+	// Concurrent resolutions of the same name and type share a single iteration.
+	resolve := func(ctx context.Context) (RRs, error) {
+		return br.flights.do(ctx, name+"|"+wireType(qtype), br.flight(func(ctx context.Context) (RRs, error) {
+			rrs, err := br.iterate(ctx, name, qtype, depth)
+			return rrs, timedOut(ctx, err)
+		}))
+	}
+	if br.staleWindow > 0 {
+		rrs, err = br.resolveStale(ctx, name, qtype, resolve)
 	} else {
-		nsRRs, err = br.ResolveCtx(ctx, parentQname, "NS")
-		if err != nil {
-			return RRs{}, err
+		rrs, err = resolve(ctx)
+	}
+	return rrs, timedOut(ctx, err)
+}
+
+// flight returns fn as the function of a flight of br.flights: the shared iteration is detached from
+// the callers, but not from the resolver, and has the timeout of a resolution.
+func (br *BottinResolver) flight(fn func(context.Context) (RRs, error)) func(context.Context) (RRs, error) {
+	return func(ctx context.Context) (RRs, error) {
+		ctx, release := br.bind(ctx)
+		defer release()
+		ctx, cancel := context.WithTimeout(ctx, br.timeout)
+		defer cancel()
+		return fn(ctx)
+	}
+}
+
+// timedOut returns ErrTimeout in place of err when a resolution ran out of time with ctx, whether it
+// failed with the deadline itself or with the lack of response it caused, and err otherwise.
+func timedOut(ctx context.Context, err error) error {
+	if err == context.DeadlineExceeded {
+		return ErrTimeout
+	}
+	// The socket deadlines expire with the deadline of ctx, a hair before it.
+	if deadline, ok := ctx.Deadline(); ok && err == ErrNoResponse && time.Until(deadline) < TypicalResponseTime {
+		return ErrTimeout
+	}
+	return err
+}
+
+// cached answers name/qtype with the cache entries returned by get, hit being the kind of entry
+// found, or "" if there is none. The results have the DNSSEC status of the entry.
+// Only answers are answered with: the glue and referral NS records in the cache are only used to
+// find nameservers (RFC 2181 section 5.4.1).
+func (br *BottinResolver) cached(name, qtype string, getAny func(key string) ([]RR, bool)) (RRs, string, error) {
+	get := func(key string) ([]RR, bool) {
+		if br.cache.Rank(key) < RankAnswer {
+			return nil, false
+		}
+		return getAny(key)
+	}
+	if soa, ok := get(nxdomainKey(name)); ok {
+		return RRs{AuthorityRRs: soa, Security: br.cache.Security(nxdomainKey(name))}, "nxdomain", NXDOMAIN
+	}
+	if answers, ok := get(name + "|" + wireType(qtype)); ok {
+		return RRs{AnswerRRs: answers, Security: br.cache.Security(name + "|" + wireType(qtype))}, "answer", nil
+	}
+	if cnames, ok := get(name + "|CNAME"); ok {
+		return RRs{AnswerRRs: cnames, Security: br.cache.Security(name + "|CNAME")}, "cname", nil
+	}
+	if soa, ok := get(nodataKey(name, qtype)); ok {
+		return RRs{AuthorityRRs: soa, Security: br.cache.Security(nodataKey(name, qtype))}, "nodata", nil
+	}
+	return RRs{}, "", nil
+}
+
+// resolveStale runs resolve, falling back to the expired records of name/qtype still in the cache
+// when it fails or doesn't complete within the client-response timeout (RFC 8767). The stale
+// records are returned with a TTL of StaleTTL, while resolve carries on to refresh the cache.
+// After a failed refresh, the stale records are served without resolving for StaleRecheck.
+func (br *BottinResolver) resolveStale(ctx context.Context, name, qtype string, resolve func(context.Context) (RRs, error)) (RRs, error) {
+	stale, hit, staleErr := br.cached(name, qtype, br.cache.GetStale)
+	if hit == "" {
+		return resolve(ctx)
+	}
+
+	key := name + "|" + wireType(qtype)
+	type result struct {
+		rrs RRs
+		err error
+	}
+	results := make(chan result, 1)
+	if br.recheckStale(key) {
+		go func() {
+			// The refresh carries on when the client gives up, until its flight, which has the
+			// timeout of a resolution, completes.
+			ctx, release := br.bind(context.WithoutCancel(ctx))
+			defer release()
+			rrs, err := resolve(ctx)
+			if ctx.Err() == nil {
+				br.staleRefreshed(key, err == nil || err == NXDOMAIN)
+			}
+			results <- result{rrs, err}
+		}()
+	} else {
+		results <- result{err: fmt.Errorf("refresh failed less than %v ago", StaleRecheck)}
+	}
+	var timer <-chan time.Time
+	if br.staleTimeout > 0 {
+		timer = time.After(br.staleTimeout)
+	}
+
+	reason := "client timeout"
+	select {
+	case r := <-results:
+		if r.err == nil || r.err == NXDOMAIN {
+			return r.rrs, r.err
 		}
+		reason = r.err.Error()
+	case <-timer:
+	case <-ctx.Done():
+		reason = ctx.Err().Error()
+	}
+	br.trace(ctx, "serve stale", slog.String("qname", name), slog.String("qtype", wireType(qtype)),
+		slog.String("entry", hit), slog.String("reason", reason))
+	stale.AnswerRRs = staleRRs(stale.AnswerRRs)
+	stale.AuthorityRRs = staleRRs(stale.AuthorityRRs)
+	return stale, staleErr
+}
+
+// recheckStale reports whether the stale entries of key can be refreshed: whether its last refresh
+// didn't fail, or failed StaleRecheck ago.
+func (br *BottinResolver) recheckStale(key string) bool {
+	br.staleMutex.Lock()
+	defer br.staleMutex.Unlock()
+	failed, ok := br.staleFailures[key]
+	if ok && br.clock.Now().Sub(failed) >= StaleRecheck {
+		delete(br.staleFailures, key)
+		return true
+	}
+	return !ok
+}
+
+// staleRefreshed records whether the refresh of the stale entries of key succeeded.
+func (br *BottinResolver) staleRefreshed(key string, ok bool) {
+	br.staleMutex.Lock()
+	defer br.staleMutex.Unlock()
+	if ok {
+		delete(br.staleFailures, key)
+	} else {
+		br.staleFailures[key] = br.clock.Now()
+	}
+}
+
+// refresh resolves the name and type of the cache key again, to prefetch the entry before it expires.
+func (br *BottinResolver) refresh(key string) {
+	name, qtype, _ := strings.Cut(key, "|")
+	qtype = strings.TrimSuffix(qtype, "|NODATA")
+	if qtype == "NXDOMAIN" {
+		return // The NXDOMAIN entry applies to every type.
 	}
+	ctx, cancel := context.WithTimeout(br.lifetime, br.timeout)
+	defer cancel()
+	br.trace(ctx, "prefetch", slog.String("qname", name), slog.String("qtype", qtype))
+	br.flights.do(ctx, name+"|"+qtype, br.flight(func(ctx context.Context) (RRs, error) {
+		return br.iterate(ctx, name, qtype, 0)
+	}))
+}
 
-	return br.exchange(ctx, qname, qtype, nsRRs)
+// staleRRs returns copies of rrs with a TTL of StaleTTL.
+func staleRRs(rrs []RR) []RR {
+	if len(rrs) == 0 {
+		return rrs
+	}
+	out := make([]RR, len(rrs))
+	for i, rr := range rrs {
+		rr.TTL = StaleTTL
+		out[i] = rr
+	}
+	return out
 }
 
-// perform none recursive query using miekg dns
-func (br *BottinResolver) exchange(ctx context.Context, qname, qtype string, nsRRs RRs) (RRs, error) {
-	var results RRs
-	dnsType, ok := dns.StringToType[qtype]
+// iterate walks down the delegation chain, following referrals until a server answers for qname.
+func (br *BottinResolver) iterate(ctx context.Context, qname, qtype string, depth int) (RRs, error) {
+	ctx, ok := withPending(ctx, qname+"|"+wireType(qtype))
 	if !ok {
-		return RRs{}, errors.New("invalid query type")
+		return RRs{}, ErrMaxRecursion
+	}
+	resp, zone, err := br.descend(ctx, qname, qtype, depth)
+	if err != nil {
+		return RRs{}, err
+	}
+
+	var answers []RR
+	for _, drr := range resp.Answer {
+		if drr.Header().Rrtype == dns.TypeRRSIG && wireType(qtype) != "RRSIG" {
+			continue // Signatures are only used for validation.
+		}
+		if rr, ok := convertRR(drr, br.expire, br.clock.Now()); ok {
+			answers = append(answers, rr)
+		}
+	}
+	links, target := chain(answers, qname)
+	for _, rr := range answers {
+		if rr.Name == target && rr.Type != "CNAME" && rr.Type != "DNAME" {
+			links = append(links, rr)
+		}
+	}
+
+	var security SecurityStatus
+	if br.dnssec {
+		nxdomain := resp.Rcode == dns.RcodeNameError
+		status, reason, err := br.validateResponse(ctx, resp, zone, target, qtype, nxdomain, !nxdomain && len(links) == 0, depth)
+		if err != nil {
+			return RRs{}, err
+		}
+		br.trace(ctx, "dnssec", slog.String("zone", zone), slog.String("qname", qname), slog.String("qtype", wireType(qtype)),
+			slog.String("status", status.String()))
+		if status == Bogus {
+			return RRs{}, &BogusError{Name: qname, Type: wireType(qtype), Reason: reason}
+		}
+		security = status
 	}
 
-	for _, nsRR := range nsRRs.AnswerRRs {
-		// Create a DNS client and set the timeout
-		client := new(dns.Client)
-		client.Timeout = 5 * time.Second
+	rank := RankAnswer
+	if resp.Authoritative {
+		rank = RankAuthAnswer
+	}
+	br.cacheRRs(links, rank, security)
+
+	if resp.Rcode == dns.RcodeNameError {
+		// The last name of the chain doesn't exist.
+		soa := negativeSOA(resp, target, br.clock.Now())
+		br.trace(ctx, "nxdomain", slog.String("zone", zone), slog.String("qname", target))
+		br.cacheNegative(nxdomainKey(target), soa, security)
+		return RRs{AnswerRRs: links, AuthorityRRs: soa, Security: security}, NXDOMAIN
+	}
+	if len(links) == 0 {
+		// NODATA: the name exists, but has no records of this type.
+		soa := negativeSOA(resp, qname, br.clock.Now())
+		br.trace(ctx, "nodata", slog.String("zone", zone), slog.String("qname", qname), slog.String("qtype", wireType(qtype)))
+		br.cacheNegative(nodataKey(qname, qtype), soa, security)
+		return RRs{AuthorityRRs: soa, Security: security}, nil
+	}
+	br.trace(ctx, "answer", slog.String("zone", zone), slog.String("qname", qname), slog.String("qtype", wireType(qtype)), slog.Int("records", len(links)))
+	return RRs{AnswerRRs: links, Security: security}, nil
+}
 
-		// Create a DNS message for the query
-		msg := new(dns.Msg)
-		msg.SetQuestion(dns.Fqdn(qname), dnsType)
-		msg.RecursionDesired = false // Non-recursive query
+// descend follows the referrals from the closest known zone cut down to the zone whose nameservers
+// answer qname/qtype, and returns their response and that zone. DS records are asked to the
+// nameservers of the parent zone, which hold them (RFC 4035 section 4.2).
+func (br *BottinResolver) descend(ctx context.Context, qname, qtype string, depth int) (*dns.Msg, string, error) {
+	zone := "."
+	if recorder(ctx) == nil {
+		start := qname
+		if wireType(qtype) == "DS" {
+			start, _ = parent(qname)
+		}
+		zone = br.closestZone(start)
+	}
+	br.trace(ctx, "zone cut", slog.String("qname", qname), slog.String("zone", zone))
+	minimal := br.minimal(zone, qname)
+	for {
+		if minimal != "" {
+			// QNAME minimisation: look for the next zone cut with the fewest labels of qname.
+			resp, err := br.query(ctx, zone, minimal, MinimizeQType, depth)
+			if err != nil {
+				if br.minimize == MinimizeStrict || ctx.Err() != nil || err == ErrTimeout {
+					br.trace(ctx, "no response", slog.String("zone", zone), slog.String("qname", minimal), slog.String("error", err.Error()))
+					return nil, "", err
+				}
+				// The nameservers may not handle minimised queries, send them qname itself.
+				br.trace(ctx, "minimisation fallback", slog.String("zone", zone), slog.String("qname", minimal), slog.String("error", err.Error()))
+				minimal = ""
+				continue
+			}
+			br.bailiwick(ctx, resp, zone)
 
-		// Get the nameserver address from the RR
-		nsAddr := nsRR.Value // Assume `nsRR.Value` contains the IP address of the nameserver
+			if cut, ok := referral(resp, zone, minimal); ok {
+				br.trace(ctx, "referral", slog.String("zone", zone), slog.String("cut", cut))
+				br.cacheReferral(resp, cut)
+				zone = cut
+				minimal = br.minimal(cut, qname)
+				continue
+			}
+			if resp.Rcode == dns.RcodeNameError {
+				if br.minimize == MinimizeRelaxed {
+					// Some nameservers deny empty non-terminals, send them qname itself.
+					br.trace(ctx, "minimisation fallback", slog.String("zone", zone), slog.String("qname", minimal), slog.String("error", NXDOMAIN.Error()))
+					minimal = ""
+					continue
+				}
+				// Nothing exists below a name that doesn't exist (RFC 8020): the response denies qname too.
+				return resp, zone, nil
+			}
+			// No zone cut at minimal, the nameservers of zone are also authoritative for the next label.
+			minimal = br.minimal(minimal, qname)
+			continue
+		}
 
-		// Send the query to the nameserver
-		fmt.Printf(">>>> trying: %s + %#v\n", msg, nsAddr)
-		resp, _, err := client.ExchangeContext(ctx, msg, nsAddr+":53")
+		resp, err := br.query(ctx, zone, qname, qtype, depth)
 		if err != nil {
-			fmt.Printf("%#v\n", err)
+			br.trace(ctx, "no response", slog.String("zone", zone), slog.String("qname", qname), slog.String("error", err.Error()))
+			return nil, "", err
+		}
+		br.bailiwick(ctx, resp, zone)
+
+		if cut, ok := referral(resp, zone, qname); ok {
+			br.trace(ctx, "referral", slog.String("zone", zone), slog.String("cut", cut))
+			br.cacheReferral(resp, cut)
+			zone = cut
+			continue
+		}
+		return resp, zone, nil
+	}
+}
+
+// query sends qname/qtype to the nameservers of zone until one of them gives a usable response.
+// At most MaxNameservers nameservers, and MaxIPs addresses for each of them, are tried.
+// Nameservers with known addresses are tried first, the fastest ones first.
+func (br *BottinResolver) query(ctx context.Context, zone, qname, qtype string, depth int) (*dns.Msg, error) {
+	glued, glueless := br.nameserverHosts(zone)
+	if len(glued) > MaxNameservers {
+		glued = glued[:MaxNameservers]
+	}
+
+	err := ErrNoARecords
+	var addrs []string
+	for _, host := range glued {
+		hostAddrs := br.knownAddresses(host)
+		if len(hostAddrs) > MaxIPs {
+			hostAddrs = hostAddrs[:MaxIPs]
+		}
+		addrs = append(addrs, hostAddrs...)
+	}
+	if len(addrs) > 0 {
+		resp, exErr := br.race(ctx, zone, br.infra.sort(addrs), qname, qtype)
+		if exErr == nil {
+			return resp, nil
+		}
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return nil, ctxErr
+		}
+		if exErr == ErrTimeout {
+			return nil, exErr
+		}
+		err = ErrNoResponse
+	}
+
+	// Glueless nameservers need their addresses resolved first, so they're tried one at a time.
+	tried := len(glued)
+	for _, host := range glueless {
+		if tried >= MaxNameservers {
+			break
+		}
+		hostAddrs, addrErr := br.addresses(ctx, host, depth)
+		if addrErr != nil {
+			if ctxErr := ctx.Err(); ctxErr != nil {
+				return nil, ctxErr
+			}
+			if addrErr == ErrTimeout {
+				return nil, addrErr
+			}
+			if err != ErrNoResponse && addrErr == ErrMaxRecursion {
+				err = addrErr
+			}
+			continue
+		}
+		tried++
+		if len(hostAddrs) > MaxIPs {
+			hostAddrs = hostAddrs[:MaxIPs]
+		}
+		resp, exErr := br.race(ctx, zone, br.infra.sort(hostAddrs), qname, qtype)
+		if exErr != nil {
+			if ctxErr := ctx.Err(); ctxErr != nil {
+				return nil, ctxErr
+			}
+			if exErr == ErrTimeout {
+				return nil, exErr
+			}
+			err = ErrNoResponse
 			continue // Try the next nameserver if there's an error
 		}
+		return resp, nil
+	}
+	return nil, err
+}
+
+// race sends the query to the nameserver addresses addrs in turn, until one gives a usable response.
+// With hedging or the HappyEyeballs policy, the next address is also queried when the previous one
+// hasn't answered in time, without waiting for it to fail.
+func (br *BottinResolver) race(ctx context.Context, zone string, addrs []string, qname, qtype string) (*dns.Msg, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type result struct {
+		resp *dns.Msg
+		err  error
+	}
+	results := make(chan result, len(addrs))
+	next, inflight := 0, 0
+	start := func() {
+		nsAddr := addrs[next]
+		next++
+		inflight++
+		go func() {
+			resp, err := br.exchange(ctx, zone, nsAddr, qname, qtype)
+			if err == nil && resp.Rcode != dns.RcodeSuccess && resp.Rcode != dns.RcodeNameError {
+				err = ErrNoResponse // Lame or broken server
+			}
+			results <- result{resp, err}
+		}()
+	}
 
-		// Process the response and add records to results
-		for _, rr := range resp.Answer {
-			crr, _ := convertRR(rr, true)
-			results.AnswerRRs = append(results.AnswerRRs, crr)
+	err := ErrNoResponse
+	start()
+	for inflight > 0 {
+		var timer <-chan time.Time
+		if stagger := br.stagger(addrs[next-1]); stagger > 0 && next < len(addrs) {
+			timer = time.After(stagger)
 		}
-		if len(results.AnswerRRs) > 0 {
-			fmt.Printf(">>>>>> %#v\n", results)
-			return results, nil // Return if we got a successful response
+		select {
+		case r := <-results:
+			inflight--
+			if r.err == nil {
+				return r.resp, nil
+			}
+			if r.err == ErrTimeout || err != ErrTimeout {
+				err = r.err
+			}
+			if next < len(addrs) && r.err != ErrTimeout {
+				start() // Try the next address if there's an error
+			}
+		case <-timer:
+			start()
 		}
 	}
+	return nil, err
+}
+
+// stagger returns how long a query to nsAddr runs alone before the next address is queried in
+// parallel, 0 to wait for it to fail.
+func (br *BottinResolver) stagger(nsAddr string) time.Duration {
+	var stagger time.Duration
+	if br.hedge {
+		stagger = br.infra.srtt(nsAddr)
+	}
+	if br.family == HappyEyeballs && (stagger == 0 || HappyEyeballsDelay < stagger) {
+		stagger = HappyEyeballsDelay
+	}
+	return stagger
+}
+
+// addresses returns the IP addresses of the nameserver host, resolving them when no glue is known.
+// The addresses are filtered and ordered according to the address family policy.
+func (br *BottinResolver) addresses(ctx context.Context, host string, depth int) ([]string, error) {
+	addrs := br.knownAddresses(host)
+	if len(addrs) > 0 {
+		return addrs, nil
+	}
+
+	// Glueless delegation: resolve the nameserver address with its own recursion budget.
+	br.trace(ctx, "glueless nameserver", slog.String("host", host), slog.Int("depth", depth+1))
+	cyclic := false
+	for _, qtype := range br.family.qtypes() {
+		if isPending(ctx, host+"|"+qtype) {
+			cyclic = true // cyclic dependency, this host can't be reached
+			continue
+		}
+		rrs, err := br.resolve(ctx, host, qtype, depth+1)
+		if err != nil {
+			if err == ErrMaxRecursion || err == ErrTimeout || ctx.Err() != nil {
+				return nil, err
+			}
+			continue
+		}
+		for _, rr := range rrs.AnswerRRs {
+			if rr.Type == qtype {
+				addrs = append(addrs, rr.Value)
+			}
+		}
+		if len(addrs) > 0 && br.family != HappyEyeballs {
+			break
+		}
+	}
+	if len(addrs) == 0 {
+		if cyclic {
+			return nil, ErrMaxRecursion
+		}
+		return nil, ErrNoARecords
+	}
+	return br.family.order(addrs), nil
+}
+
+// knownAddresses returns the cached or hinted IP addresses of the nameserver host usable with the
+// address family policy, in the order it prefers.
+func (br *BottinResolver) knownAddresses(host string) []string {
+	var addrs []string
+	for _, qtype := range br.family.qtypes() {
+		for _, rr := range br.lookup(host + "|" + qtype) {
+			addrs = append(addrs, rr.Value)
+		}
+	}
+	return br.family.order(addrs)
+}
+
+// perform none recursive query using miekg dns, sending it to nsAddr, a nameserver of zone
+func (br *BottinResolver) exchange(ctx context.Context, zone, nsAddr, qname, qtype string) (*dns.Msg, error) {
+	dnsType, ok := dns.StringToType[wireType(qtype)]
+	if !ok {
+		return nil, errors.New("invalid query type")
+	}
+
+	// Bail out if the query can't complete before the deadline of the resolution
+	timeout := br.timeout
+	if deadline, ok := ctx.Deadline(); ok {
+		remaining := time.Until(deadline)
+		if remaining < TypicalResponseTime {
+			return nil, ErrTimeout
+		}
+		if remaining < timeout {
+			timeout = remaining
+		}
+	}
+
+	network := "udp"
+	if br.forceTCP(zone, nsAddr) {
+		network = "tcp"
+	}
+
+	// Create a DNS message for the query
+	msg := new(dns.Msg)
+	msg.SetQuestion(dns.Fqdn(qname), dnsType)
+	msg.RecursionDesired = false // Non-recursive query
+	randomized := br.randomizeCase && !br.infra.no0x20(nsAddr)
+	if randomized {
+		msg.Question[0].Name = randomCase(msg.Question[0].Name)
+	}
+	edns := br.ednsSize > 0 && !br.infra.noEDNS(nsAddr)
+	if edns {
+		msg.SetEdns0(br.ednsSize, br.dnssec) // The DO bit asks for the DNSSEC records.
+	}
+
+	resp, err := br.send(ctx, zone, msg, nsAddr, network, timeout)
+	if edns && ctx.Err() == nil && br.ednsFailed(nsAddr, resp, err) {
+		// The server may not handle EDNS0, fall back to plain DNS and remember it if that works
+		plain := new(dns.Msg)
+		plain.SetQuestion(msg.Question[0].Name, dnsType)
+		plain.RecursionDesired = false
+		br.trace(ctx, "edns fallback", slog.String("server", nsAddr))
+		plainResp, plainErr := br.send(ctx, zone, plain, nsAddr, network, timeout)
+		if plainErr == nil && plainResp.Rcode != dns.RcodeFormatError && plainResp.Rcode != dns.RcodeNotImplemented {
+			br.infra.update(nsAddr, func(info *serverInfo) { info.noEDNS, info.ednsTimeouts = br.clock.Now(), 0 })
+			resp, err = plainResp, nil
+		}
+	}
+	if randomized && err == nil && resp.Question[0].Name != msg.Question[0].Name {
+		// The case of the question wasn't echoed: either a spoofed response or a server that
+		// doesn't preserve case. TCP can't be spoofed as easily, its response decides which.
+		br.trace(ctx, "0x20 mismatch", slog.String("server", nsAddr), slog.String("sent", msg.Question[0].Name),
+			slog.String("received", resp.Question[0].Name))
+		tcpResp, tcpErr := br.send(ctx, zone, msg, nsAddr, "tcp", timeout)
+		if tcpErr == nil && tcpResp.Question[0].Name != msg.Question[0].Name {
+			br.infra.update(nsAddr, func(info *serverInfo) { info.no0x20 = br.clock.Now() })
+		}
+		return tcpResp, tcpErr
+	}
+	return resp, err
+}
+
+// ednsFailed reports whether the response resp, or the error err, of an EDNS0 query to nsAddr calls
+// for a plain DNS retry: the server rejected EDNS0 with FORMERR or NOTIMP, or its EDNS0 queries keep
+// timing out (RFC 6891 section 7).
+func (br *BottinResolver) ednsFailed(nsAddr string, resp *dns.Msg, err error) bool {
+	if err != nil {
+		if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+			return br.infra.ednsTimeout(nsAddr)
+		}
+		return false
+	}
+	if resp.Rcode == dns.RcodeFormatError || resp.Rcode == dns.RcodeNotImplemented {
+		return true
+	}
+	br.infra.ednsAnswered(nsAddr)
+	return false
+}
+
+// send sends msg to nsAddr, a nameserver of zone, over network, retrying over TCP if the UDP response
+// is truncated.
+func (br *BottinResolver) send(ctx context.Context, zone string, msg *dns.Msg, nsAddr, network string, timeout time.Duration) (*dns.Msg, error) {
+	exchangeCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	// Send the query to the nameserver
+	question := msg.Question[0]
+	resp, rtt, err := br.exchanger.Exchange(exchangeCtx, msg, network, net.JoinHostPort(nsAddr, "53"))
+	if err != nil {
+		br.trace(ctx, "query failed", slog.String("server", nsAddr), slog.String("network", network),
+			slog.String("qname", question.Name), slog.String("qtype", dns.TypeToString[question.Qtype]),
+			slog.String("error", err.Error()))
+		br.recordHop(ctx, zone, nsAddr, network, msg, nil, 0, err)
+		if netErr, ok := err.(net.Error); ok && netErr.Timeout() && ctx.Err() == nil {
+			br.infra.timeout(nsAddr)
+		}
+		return nil, err
+	}
+	if err := validate(msg, resp); err != nil {
+		// Likely a spoofing attempt, the response can't be trusted.
+		br.trace(ctx, "bad response", slog.String("server", nsAddr), slog.String("network", network),
+			slog.String("qname", question.Name), slog.String("qtype", dns.TypeToString[question.Qtype]),
+			slog.String("error", err.Error()))
+		br.recordHop(ctx, zone, nsAddr, network, msg, nil, rtt, ErrBadResponse)
+		return nil, ErrBadResponse
+	}
+	br.infra.rtt(nsAddr, rtt)
+	br.trace(ctx, "query", slog.String("server", nsAddr), slog.String("network", network),
+		slog.String("qname", question.Name), slog.String("qtype", dns.TypeToString[question.Qtype]),
+		slog.Duration("rtt", rtt), slog.String("rcode", dns.RcodeToString[resp.Rcode]),
+		slog.Bool("truncated", resp.Truncated))
+	br.recordHop(ctx, zone, nsAddr, network, msg, resp, rtt, nil)
+
+	// Retry over TCP to the same server if the UDP response didn't fit
+	if resp.Truncated && network == "udp" && br.tcpRetry {
+		return br.send(ctx, zone, msg, nsAddr, "tcp", timeout)
+	}
+	return resp, nil
+}
+
+// validate checks that resp answers the query msg: same ID, QR bit set, and the same question, the
+// case of the name aside. A response failing these checks may be spoofed.
+func validate(msg, resp *dns.Msg) error {
+	switch {
+	case resp.Id != msg.Id:
+		return fmt.Errorf("ID mismatch: sent %d, received %d", msg.Id, resp.Id)
+	case !resp.Response:
+		return errors.New("QR bit not set")
+	case len(resp.Question) != 1:
+		return fmt.Errorf("%d questions in response", len(resp.Question))
+	}
+	q, rq := msg.Question[0], resp.Question[0]
+	if rq.Qtype != q.Qtype || rq.Qclass != q.Qclass || !strings.EqualFold(rq.Name, q.Name) {
+		return fmt.Errorf("question mismatch: sent %s, received %s", q.String(), rq.String())
+	}
+	return nil
+}
 
-	return RRs{}, nil
+// forceTCP reports whether queries to nsAddr, a nameserver of zone, must always be sent over TCP.
+func (br *BottinResolver) forceTCP(zone, nsAddr string) bool {
+	for _, addr := range br.tcpServers {
+		if addr == nsAddr {
+			return true
+		}
+	}
+	for _, tcpZone := range br.tcpZones {
+		if dns.IsSubDomain(tcpZone, zone) {
+			return true
+		}
+	}
+	return false
+}
+
+// closestZone returns the deepest ancestor of qname (or qname itself) with cached nameservers.
+func (br *BottinResolver) closestZone(qname string) string {
+	for zone, ok := qname, true; ok; zone, ok = parent(zone) {
+		if zone == "." {
+			break
+		}
+		if len(br.lookup(zone+"|NS")) > 0 {
+			return zone
+		}
+	}
+	return "."
+}
+
+// nameserverHosts returns the nameserver names of zone, split between the ones with known
+// addresses, fastest first, and the glueless ones.
+func (br *BottinResolver) nameserverHosts(zone string) (glued, glueless []string) {
+	srtts := make(map[string]time.Duration)
+	for _, ns := range br.lookup(zone + "|NS") {
+		addrs := br.knownAddresses(ns.Value)
+		if len(addrs) == 0 {
+			glueless = append(glueless, ns.Value)
+			continue
+		}
+		glued = append(glued, ns.Value)
+		srtts[ns.Value] = br.infra.srtt(br.infra.sort(addrs)[0])
+	}
+	sort.SliceStable(glued, func(i, j int) bool {
+		return srtts[glued[i]] < srtts[glued[j]]
+	})
+	return glued, glueless
+}
+
+// lookup reads key from the cache, falling back to the root hints.
+func (br *BottinResolver) lookup(key string) []RR {
+	if rrs, ok := br.cache.Get(key); ok {
+		return rrs
+	}
+	rrs, _ := br.root.Get(key)
+	return rrs
+}
+
+// cacheReferral stores the delegation NS set for cut and the glue for its nameservers.
+func (br *BottinResolver) cacheReferral(resp *dns.Msg, cut string) {
+	var nsRRs, glue []RR
+	hosts := make(map[string]bool)
+	for _, drr := range resp.Ns {
+		if rr, ok := convertRR(drr, br.expire, br.clock.Now()); ok && rr.Type == "NS" && rr.Name == cut {
+			hosts[rr.Value] = true
+			nsRRs = append(nsRRs, rr)
+		}
+	}
+	for _, drr := range resp.Extra {
+		if rr, ok := convertRR(drr, br.expire, br.clock.Now()); ok && (rr.Type == "A" || rr.Type == "AAAA") && hosts[rr.Name] {
+			glue = append(glue, rr)
+		}
+	}
+	br.cacheRRs(nsRRs, RankAuthority, Indeterminate)
+	br.cacheRRs(glue, RankAdditional, Indeterminate)
+}
+
+// bailiwick drops the records of resp outside of zone, the zone of the server that sent it, as that
+// server has no authority over them (RFC 2181 section 5.4.1).
+func (br *BottinResolver) bailiwick(ctx context.Context, resp *dns.Msg, zone string) {
+	filter := func(section []dns.RR) []dns.RR {
+		kept := section[:0]
+		for _, drr := range section {
+			name := toLowerFQDN(drr.Header().Name)
+			if drr.Header().Rrtype == dns.TypeOPT || dns.IsSubDomain(zone, name) {
+				kept = append(kept, drr)
+				continue
+			}
+			br.trace(ctx, "out of bailiwick", slog.String("zone", zone), slog.String("name", name),
+				slog.String("type", dns.TypeToString[drr.Header().Rrtype]))
+		}
+		return kept
+	}
+	resp.Answer = filter(resp.Answer)
+	resp.Ns = filter(resp.Ns)
+	resp.Extra = filter(resp.Extra)
+}
+
+// cacheNegative stores the SOA of a negative response under key, with its DNSSEC status. Responses
+// without an SOA are not cached, nor are the ones with a zero negative TTL, like other records
+// (RFC 2308 section 5).
+func (br *BottinResolver) cacheNegative(key string, soa []RR, security SecurityStatus) {
+	if len(soa) == 0 {
+		return
+	}
+	br.cache.SetNegativeValidated(key, soa, security)
+}
+
+// cacheRRs groups rrs into RRsets and stores each of them in the cache with the given rank and
+// DNSSEC status, unless the cache holds the RRset with a higher rank.
+func (br *BottinResolver) cacheRRs(rrs []RR, rank Rank, security SecurityStatus) {
+	sets := make(map[string][]RR)
+	var keys []string
+	for _, rr := range rrs {
+		key := rr.Key()
+		if _, ok := sets[key]; !ok {
+			keys = append(keys, key)
+		}
+		sets[key] = append(sets[key], rr)
+	}
+	for _, key := range keys {
+		br.cache.SetValidated(key, sets[key], rank, security)
+	}
+}
+
+// result completes the RRs returned for qname with the delegation NS records of qname.
+func (br *BottinResolver) result(qname, qtype string, results RRs) RRs {
+	if wireType(qtype) != "NS" {
+		if nsRRs, ok := br.cache.Get(qname + "|NS"); ok {
+			results.AnswerRRs = append(results.AnswerRRs, nsRRs...)
+		}
+	}
+	return results
+}
+
+// chain follows the CNAME and DNAME records of rrs from name. It returns the links of the chain,
+// with a CNAME synthesized after each DNAME (RFC 6672 section 3.2), and the name it ends at.
+func chain(rrs []RR, name string) ([]RR, string) {
+	var links []RR
+	seen := make(map[string]bool)
+	for !seen[name] && len(links) <= 2*MaxCNAMEs {
+		seen[name] = true
+		if dname, ok := findDNAME(rrs, name); ok {
+			cname := dname
+			cname.Name = name
+			cname.Type = "CNAME"
+			cname.Value = strings.TrimSuffix(name, dname.Name) + dname.Value
+			links = append(links, dname, cname)
+			name = cname.Value
+			continue
+		}
+		cname, ok := find(rrs, name, "CNAME")
+		if !ok {
+			break
+		}
+		links = append(links, cname)
+		name = cname.Value
+	}
+	return links, name
+}
+
+// findDNAME returns the DNAME record of rrs redirecting the subtree name belongs to.
+func findDNAME(rrs []RR, name string) (RR, bool) {
+	for _, rr := range rrs {
+		if rr.Type == "DNAME" && rr.Name != "." && rr.Name != name && dns.IsSubDomain(rr.Name, name) {
+			return rr, true
+		}
+	}
+	return RR{}, false
+}
+
+// find returns the first record of rrs with the given name and type.
+func find(rrs []RR, name, rrtype string) (RR, bool) {
+	for _, rr := range rrs {
+		if rr.Name == name && rr.Type == rrtype {
+			return rr, true
+		}
+	}
+	return RR{}, false
+}
+
+// has reports whether rrs holds a record with the given name and type.
+func has(rrs []RR, name, rrtype string) bool {
+	_, ok := find(rrs, name, rrtype)
+	return ok
+}
+
+// negativeSOA returns the SOA record of a negative response for qname, with its TTL set to the
+// negative caching TTL: the minimum of the SOA TTL and of its MINIMUM field (RFC 2308 section 5).
+// The response was received at now.
+func negativeSOA(resp *dns.Msg, qname string, now time.Time) []RR {
+	for _, drr := range resp.Ns {
+		soa, ok := drr.(*dns.SOA)
+		if !ok || !dns.IsSubDomain(toLowerFQDN(soa.Hdr.Name), qname) {
+			continue
+		}
+		ttl := soa.Hdr.Ttl
+		if soa.Minttl < ttl {
+			ttl = soa.Minttl
+		}
+		rr, _ := convertRR(soa, true, now)
+		rr.TTL = time.Duration(ttl) * time.Second
+		return []RR{rr}
+	}
+	return nil
+}
+
+// nxdomainKey is the cache key of the negative entry for a nonexistent qname.
+func nxdomainKey(qname string) string {
+	return qname + "|NXDOMAIN"
+}
+
+// nodataKey is the cache key of the negative entry for a qname without records of type qtype.
+func nodataKey(qname, qtype string) string {
+	return qname + "|" + wireType(qtype) + "|NODATA"
+}
+
+// referral reports whether resp delegates qname to a zone cut below zone, and returns that cut.
+func referral(resp *dns.Msg, zone, qname string) (string, bool) {
+	if resp.Rcode != dns.RcodeSuccess || resp.Authoritative || len(resp.Answer) > 0 {
+		return "", false
+	}
+	for _, drr := range resp.Ns {
+		ns, ok := drr.(*dns.NS)
+		if !ok {
+			continue
+		}
+		cut := toLowerFQDN(ns.Hdr.Name)
+		if cut != zone && dns.IsSubDomain(zone, cut) && dns.IsSubDomain(cut, qname) {
+			return cut, true
+		}
+	}
+	return "", false
 }
 
 func (br *BottinResolver) ResolveContext(ctx context.Context, qname, qtype string) (RRs, error) {
 	return br.ResolveCtx(ctx, qname, qtype)
 }
 
+// ResolveTrace resolves qname/qtype from the root nameservers, bypassing the cache, like dig +trace.
+// Along with the result, it returns the upstream queries made, in order.
+func (br *BottinResolver) ResolveTrace(ctx context.Context, qname, qtype string) (RRs, *Trace, error) {
+	trace := new(Trace)
+	rrs, err := br.ResolveCtx(context.WithValue(ctx, traceKey{}, trace), qname, qtype)
+	return rrs, trace, err
+}
+
 func (br *BottinResolver) ResolveErr(qname, qtype string) (RRs, error) {
-	return br.ResolveCtx(context.Background(), qname, qtype)
+	ctx, cancel := context.WithTimeout(context.Background(), br.timeout)
+	defer cancel()
+	return br.ResolveCtx(ctx, qname, qtype)
 }
@@ -12,14 +12,17 @@ Original source: https://github.com/domainr/dnsr
 */
 
 import (
+	"bytes"
 	"context"
 	"flag"
 	"fmt"
 	"net"
 	"os"
+	"strings"
 	"testing"
 	"time"
 
+	"github.com/kakwa/bottin/bottintest"
 	"github.com/nbio/st"
 )
 
@@ -32,68 +35,169 @@ func TestMain(m *testing.M) {
 	if os.Getenv("DNSR_DEBUG") != "" {
 		DebugLogger = os.Stderr
 	}
+	if os.Getenv("DNSR_LIVE") == "" {
+		testExchanger = newTestNetwork()
+	}
 	os.Exit(m.Run())
 }
 
+// testExchanger serves the resolutions of the tests from a simulated hierarchy, or from the
+// internet when it is nil (DNSR_LIVE set).
+var testExchanger Exchanger
+
+// newTestResolver returns a resolver sending its queries through testExchanger.
+func newTestResolver(options ...Option) *BottinResolver {
+	if testExchanger != nil {
+		options = append([]Option{WithExchanger(testExchanger)}, options...)
+	}
+	return NewResolver(options...)
+}
+
+// lookupTXT returns the TXT records of domain, as the system resolver or the simulated hierarchy
+// have them.
+func lookupTXT(domain string) ([]string, error) {
+	if testExchanger == nil {
+		return net.LookupTXT(domain)
+	}
+	return testTXT(domain), nil
+}
+
 func TestWithCache(t *testing.T) {
-	NewResolver(WithCache(99))
-	//st.Expect(t, r.cache.capacity, 99)
+	r := NewResolver(WithCache(99))
+	st.Expect(t, r.cache.capacity, 99)
+}
+
+func TestWithCacheOptions(t *testing.T) {
+	r := NewResolver(WithExpiry(), WithCacheOptions(WithMaxTTL(time.Minute)))
+	st.Expect(t, r.cache.ttls.max, time.Minute)
+	st.Expect(t, r.cache.ttls.noExpiry, false)
+	r = NewResolver()
+	st.Expect(t, r.cache.ttls.noExpiry, true)
 }
 
 func TestWithDialer(t *testing.T) {
 	d := &net.Dialer{}
-	NewResolver(WithDialer(d))
-	//st.Expect(t, r.dialer, d)
+	r := NewResolver(WithDialer(d))
+	st.Expect(t, r.dialer, d)
 }
 
 func TestWithExpiry(t *testing.T) {
-	NewResolver(WithExpiry())
-	//st.Expect(t, r.expire, true)
+	r := NewResolver(WithExpiry())
+	st.Expect(t, r.expire, true)
 }
 
 func TestWithTimeout(t *testing.T) {
-	NewResolver(WithTimeout(99 * time.Second))
-	//st.Expect(t, r.timeout, 99*time.Second)
+	r := NewResolver(WithTimeout(99 * time.Second))
+	st.Expect(t, r.timeout, 99*time.Second)
 }
 
 func TestNewExpiring(t *testing.T) {
-	NewExpiring(42)
-	//st.Expect(t, r.cache.capacity, 42)
-	//st.Expect(t, r.expire, true)
+	r := NewExpiring(42)
+	st.Expect(t, r.cache.capacity, 42)
+	st.Expect(t, r.expire, true)
 }
 
 func TestNewExpiringWithTimeout(t *testing.T) {
-	NewExpiringWithTimeout(42, 99*time.Second)
-	//st.Expect(t, r.cache.capacity, 42)
-	//st.Expect(t, r.timeout, 99*time.Second)
-	//st.Expect(t, r.expire, true)
+	r := NewExpiringWithTimeout(42, 99*time.Second)
+	st.Expect(t, r.cache.capacity, 42)
+	st.Expect(t, r.timeout, 99*time.Second)
+	st.Expect(t, r.expire, true)
 }
 
 func TestNewExpiry(t *testing.T) {
-	NewResolver(WithExpiry())
-	//st.Expect(t, r.expire, true)
+	r := NewResolver(WithExpiry())
+	st.Expect(t, r.expire, true)
 }
 
-func TestSimple(t *testing.T) {
+func TestWithTCPRetry(t *testing.T) {
+	r := NewResolver(WithTCPRetry())
+	st.Expect(t, r.tcpRetry, true)
+}
+
+func TestWithTCPZones(t *testing.T) {
+	r := NewResolver(WithTCPZones("Example.COM"))
+	st.Expect(t, r.tcpZones, []string{"example.com."})
+	st.Expect(t, r.forceTCP("example.com.", "192.0.2.1"), true)
+	st.Expect(t, r.forceTCP("sub.example.com.", "192.0.2.1"), true)
+	st.Expect(t, r.forceTCP("com.", "192.0.2.1"), false)
+}
+
+func TestWithTCPServers(t *testing.T) {
+	r := NewResolver(WithTCPServers("192.0.2.1"))
+	st.Expect(t, r.forceTCP("com.", "192.0.2.1"), true)
+	st.Expect(t, r.forceTCP("com.", "192.0.2.2"), false)
+}
+
+func TestWithEDNS0(t *testing.T) {
 	r := NewResolver()
+	st.Expect(t, r.ednsSize, uint16(1232))
+	r = NewResolver(WithEDNS0(4096))
+	st.Expect(t, r.ednsSize, uint16(4096))
+	r = NewResolver(WithEDNS0(0))
+	st.Expect(t, r.ednsSize, uint16(0))
+}
+
+func TestWithAddressFamily(t *testing.T) {
+	r := NewResolver(WithAddressFamily(IPv6Only))
+	st.Expect(t, r.family, IPv6Only)
+	st.Expect(t, r.knownAddresses("a.root-servers.net."), []string{"2001:503:ba3e::2:30"})
+	r = NewResolver()
+	st.Expect(t, r.family, PreferIPv4)
+	st.Expect(t, r.knownAddresses("a.root-servers.net."), []string{"198.41.0.4", "2001:503:ba3e::2:30"})
+}
+
+func TestAddressFamilyOrder(t *testing.T) {
+	addrs := []string{"192.0.2.1", "2001:db8::1", "192.0.2.2", "2001:db8::2", "bogus"}
+	st.Expect(t, IPv4Only.order(addrs), []string{"192.0.2.1", "192.0.2.2"})
+	st.Expect(t, IPv6Only.order(addrs), []string{"2001:db8::1", "2001:db8::2"})
+	st.Expect(t, PreferIPv4.order(addrs), []string{"192.0.2.1", "192.0.2.2", "2001:db8::1", "2001:db8::2"})
+	st.Expect(t, PreferIPv6.order(addrs), []string{"2001:db8::1", "2001:db8::2", "192.0.2.1", "192.0.2.2"})
+	st.Expect(t, HappyEyeballs.order(addrs), []string{"2001:db8::1", "192.0.2.1", "2001:db8::2", "192.0.2.2"})
+}
+
+func TestWithTraceWriter(t *testing.T) {
+	var buf bytes.Buffer
+	r := NewResolver(WithTraceWriter(&buf))
+	r.cache.Set("example.com.|A", []RR{{Name: "example.com.", Type: "A", Value: "192.0.2.1", TTL: time.Hour}})
+	rrs, err := r.ResolveErr("example.com", "A")
+	st.Expect(t, err, nil)
+	st.Expect(t, len(rrs.AnswerRRs), 1)
+	st.Expect(t, strings.Contains(buf.String(), "msg=\"cache hit\" qname=example.com. qtype=A entry=answer"), true)
+
+	buf.Reset()
+	r = NewResolver(WithTraceWriter(&buf), WithTraceHandler(nil))
+	r.cache.Set("example.com.|A", []RR{{Name: "example.com.", Type: "A", Value: "192.0.2.1", TTL: time.Hour}})
+	r.ResolveErr("example.com", "A")
+	st.Expect(t, buf.Len(), 0)
+}
+
+func TestNewWithTimeout(t *testing.T) {
+	r := NewWithTimeout(42, 99*time.Second)
+	st.Expect(t, r.cache.capacity, 42)
+	st.Expect(t, r.timeout, 99*time.Second)
+	st.Expect(t, r.expire, false)
+}
+
+func TestSimple(t *testing.T) {
+	r := newTestResolver()
 	_, err := r.ResolveErr("1.com", "")
 	st.Expect(t, err, NXDOMAIN)
 }
 
 func TestTimeoutExpiration(t *testing.T) {
-	r := NewResolver(WithTimeout(10 * time.Millisecond))
+	r := newTestResolver(WithTimeout(10 * time.Millisecond))
 	_, err := r.ResolveErr("1.com", "")
 	st.Expect(t, err, ErrTimeout)
 }
 
 func TestDeadlineExceeded(t *testing.T) {
-	r := NewResolver(WithTimeout(0))
+	r := newTestResolver(WithTimeout(0))
 	_, err := r.ResolveErr("1.com", "")
 	st.Expect(t, err, context.DeadlineExceeded)
 }
 
 func TestResolveCtx(t *testing.T) {
-	r := NewResolver()
+	r := newTestResolver()
 	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
 	_, err := r.ResolveCtx(ctx, "1.com", "")
 	st.Expect(t, err, NXDOMAIN)
@@ -103,7 +207,7 @@ func TestResolveCtx(t *testing.T) {
 }
 
 func TestResolveContext(t *testing.T) {
-	r := NewResolver()
+	r := newTestResolver()
 	ctx, cancel := context.WithCancel(context.Background())
 	_, err := r.ResolveContext(ctx, "1.com", "")
 	st.Expect(t, err, NXDOMAIN)
@@ -113,28 +217,22 @@ func TestResolveContext(t *testing.T) {
 }
 
 func TestResolverCache(t *testing.T) {
-	r := NewResolver()
-	//r.cache.capacity = 10
-	//r.cache.m.Lock()
-	//st.Expect(t, len(r.cache.entries), 0)
-	//r.cache.m.Unlock()
+	r := newTestResolver(WithCache(10))
+	st.Expect(t, r.cache.Len(), 0)
 	for i := 0; i < 10; i++ {
 		r.Resolve(fmt.Sprintf("%d.com", i), "")
 	}
-	//r.cache.m.Lock()
-	//st.Expect(t, len(r.cache.entries), 10)
-	//r.cache.m.Unlock()
+	st.Expect(t, r.cache.Len(), 10)
 	rrs, err := r.ResolveErr("a.com", "")
 	st.Expect(t, err, NXDOMAIN)
 	st.Expect(t, rrs.AnswerRRs, ([]RR)(nil))
-	//r.cache.m.Lock()
-	//st.Expect(t, r.cache.entries["a.com"], entry(nil))
-	//st.Expect(t, len(r.cache.entries), 10)
-	//r.cache.m.Unlock()
+	_, ok := r.cache.Get("a.com.|NXDOMAIN")
+	st.Expect(t, ok, true)
+	st.Expect(t, r.cache.Len(), 10)
 }
 
 func TestGoogleA(t *testing.T) {
-	r := NewResolver()
+	r := newTestResolver()
 	rrs, err := r.ResolveErr("google.com", "A")
 	st.Expect(t, err, nil)
 	st.Expect(t, len(rrs.AnswerRRs) >= 4, true)
@@ -143,7 +241,7 @@ func TestGoogleA(t *testing.T) {
 }
 
 func TestGooglePTR(t *testing.T) {
-	r := NewResolver()
+	r := newTestResolver()
 	rrs, err := r.ResolveErr("99.17.217.172.in-addr.arpa", "PTR")
 	st.Expect(t, err, nil)
 	st.Expect(t, len(rrs.AnswerRRs) >= 2, true)
@@ -151,7 +249,7 @@ func TestGooglePTR(t *testing.T) {
 }
 
 func TestGooglePTRTwoLabelsDownDelegated(t *testing.T) {
-	r := NewResolver()
+	r := newTestResolver()
 	// Also check +2 labels down delegation since
 	// 8.8.8.in-addr.arpa is delegated directly from 8.in-addr.arpa (no intermediary 8.8.in-addr.arpa zone)
 	rrs, err := r.ResolveErr("8.8.8.8.in-addr.arpa", "PTR")
@@ -162,7 +260,7 @@ func TestGooglePTRTwoLabelsDownDelegated(t *testing.T) {
 }
 
 func TestGoogleMX(t *testing.T) {
-	r := NewResolver()
+	r := newTestResolver()
 	rrs, err := r.ResolveErr("google.com", "MX")
 	st.Expect(t, err, nil)
 	st.Expect(t, len(rrs.AnswerRRs) >= 4, true)
@@ -171,8 +269,10 @@ func TestGoogleMX(t *testing.T) {
 }
 
 func TestGoogleAny(t *testing.T) {
-	time.Sleep(Timeout) // To address flaky test on GitHub Actions
-	r := NewResolver()
+	if testExchanger == nil {
+		time.Sleep(Timeout) // To address flaky test on GitHub Actions
+	}
+	r := newTestResolver()
 	rrs, err := r.ResolveErr("google.com", "")
 	st.Expect(t, err, nil)
 	st.Expect(t, len(rrs.AnswerRRs) >= 1, true)
@@ -181,7 +281,7 @@ func TestGoogleAny(t *testing.T) {
 }
 
 func TestGoogleMulti(t *testing.T) {
-	r := NewResolver()
+	r := newTestResolver()
 	_, err := r.ResolveErr("google.com", "A")
 	st.Expect(t, err, nil)
 	rrs, err := r.ResolveErr("google.com", "TXT")
@@ -193,7 +293,7 @@ func TestGoogleMulti(t *testing.T) {
 }
 
 func TestGoogleCNAME(t *testing.T) {
-	r := NewResolver()
+	r := newTestResolver()
 	rrs, err := r.ResolveErr("translate.google.com", "A")
 	st.Expect(t, err, nil)
 	st.Expect(t, len(rrs.AnswerRRs) >= 1, true)
@@ -210,33 +310,33 @@ func TestCloudflareTXT(t *testing.T) {
 }
 
 func TestGoogleTXTTCPRetry(t *testing.T) {
-	r := NewResolver()
+	r := newTestResolver()
 	rrs, err := r.ResolveErr("google.com", "TXT")
 	st.Expect(t, err, nil)
 	st.Expect(t, len(rrs.AnswerRRs) >= 4, true)
 
-	r2 := NewResolver(WithTCPRetry())
+	r2 := newTestResolver(WithTCPRetry())
 	rrs2, err := r2.ResolveErr("google.com", "TXT")
 	st.Expect(t, err, nil)
 	st.Expect(t, len(rrs2.AnswerRRs) > len(rrs.AnswerRRs), true)
 }
 
 func TestAppleA(t *testing.T) {
-	r := NewResolver()
+	r := newTestResolver()
 	rrs, err := r.ResolveErr("apple.com", "A")
 	st.Expect(t, err, nil)
 	st.Expect(t, count(rrs.AnswerRRs, func(rr RR) bool { return rr.Type == "A" }) >= 1, true)
 }
 
 func TestHerokuTXT(t *testing.T) {
-	r := NewResolver()
+	r := newTestResolver()
 	rrs, err := r.ResolveErr("us-east-1-a.route.herokuapp.com", "TXT")
 	st.Expect(t, err, nil)
 	st.Expect(t, count(rrs.AnswerRRs, func(rr RR) bool { return rr.Type == "TXT" }), 0)
 }
 
 func TestHerokuMulti(t *testing.T) {
-	r := NewResolver()
+	r := newTestResolver()
 	_, err := r.ResolveErr("us-east-1-a.route.herokuapp.com", "A")
 	st.Expect(t, err, nil)
 	rrs, err := r.ResolveErr("us-east-1-a.route.herokuapp.com", "TXT")
@@ -247,7 +347,7 @@ func TestHerokuMulti(t *testing.T) {
 
 func TestBlueOvenA(t *testing.T) {
 	t.Skip("DNS changed 2018-11, so disabling this.")
-	r := NewResolver()
+	r := newTestResolver()
 	rrs, err := r.ResolveErr("blueoven.com", "A")
 	st.Expect(t, err, nil)
 	st.Expect(t, len(rrs.AnswerRRs), 2)
@@ -256,7 +356,7 @@ func TestBlueOvenA(t *testing.T) {
 
 func TestBlueOvenAny(t *testing.T) {
 	t.Skip("DNS changed 2018-11, so disabling this.")
-	r := NewResolver()
+	r := newTestResolver()
 	rrs, err := r.ResolveErr("blueoven.com", "")
 	st.Expect(t, err, nil)
 	st.Expect(t, len(rrs.AnswerRRs), 2)
@@ -265,7 +365,7 @@ func TestBlueOvenAny(t *testing.T) {
 
 func TestBlueOvenMulti(t *testing.T) {
 	t.Skip("DNS changed 2018-11, so disabling this.")
-	r := NewResolver()
+	r := newTestResolver()
 	_, err := r.ResolveErr("blueoven.com", "A")
 	st.Expect(t, err, nil)
 	_, err = r.ResolveErr("blueoven.com", "TXT")
@@ -277,8 +377,10 @@ func TestBlueOvenMulti(t *testing.T) {
 }
 
 func TestBazCoUKAny(t *testing.T) {
-	time.Sleep(Timeout) // To address flaky test on GitHub Actions
-	r := NewResolver()
+	if testExchanger == nil {
+		time.Sleep(Timeout) // To address flaky test on GitHub Actions
+	}
+	r := newTestResolver()
 	rrs, err := r.ResolveErr("baz.co.uk", "")
 	st.Expect(t, err, nil)
 	st.Expect(t, len(rrs.AnswerRRs) >= 2, true)
@@ -286,7 +388,7 @@ func TestBazCoUKAny(t *testing.T) {
 }
 
 func TestTTL(t *testing.T) {
-	r := NewExpiring(0)
+	r := newTestResolver(WithCache(0), WithExpiry())
 	rrs, err := r.ResolveErr("google.com", "A")
 	st.Expect(t, err, nil)
 	st.Assert(t, len(rrs.AnswerRRs) >= 4, true)
@@ -294,12 +396,60 @@ func TestTTL(t *testing.T) {
 	st.Expect(t, rr.Expiry.IsZero(), false)
 }
 
+func TestTTLExpiry(t *testing.T) {
+	clock := bottintest.NewClock(time.Now())
+	n := newTestNetwork()
+	r := NewResolver(WithExchanger(n), WithClock(clock), WithExpiry())
+	rrs, err := r.ResolveErr("google.com", "A")
+	st.Expect(t, err, nil)
+	a, ok := find(rrs.AnswerRRs, "google.com.", "A")
+	st.Assert(t, ok, true)
+	st.Expect(t, a.Expiry, clock.Now().Add(300*time.Second))
+
+	google := n.Server("216.239.32.10")
+	queries := google.Queries()
+	clock.Advance(299 * time.Second)
+	r.ResolveErr("google.com", "A")
+	st.Expect(t, google.Queries(), queries)
+	clock.Advance(time.Second)
+	r.ResolveErr("google.com", "A")
+	st.Expect(t, google.Queries(), queries+1)
+}
+
+func TestNegativeCacheExpiry(t *testing.T) {
+	clock := bottintest.NewClock(time.Now())
+	n := newTestNetwork()
+	r := NewResolver(WithExchanger(n), WithClock(clock))
+	google := n.Server("216.239.32.10")
+
+	// The negative answers of google.com are cached for the 60s of its SOA minimum.
+	tests := []struct {
+		name, qtype string
+		err         error
+	}{
+		{"missing.google.com", "A", NXDOMAIN},
+		{"google.com", "AAAA", nil}, // NODATA
+	}
+	for _, q := range tests {
+		rrs, err := r.ResolveErr(q.name, q.qtype)
+		st.Expect(t, err, q.err)
+		st.Expect(t, count(rrs.AnswerRRs, func(rr RR) bool { return rr.Type == q.qtype }), 0)
+		queries := google.Queries()
+		clock.Advance(59 * time.Second)
+		r.ResolveErr(q.name, q.qtype)
+		st.Expect(t, google.Queries(), queries)
+		clock.Advance(time.Second)
+		r.ResolveErr(q.name, q.qtype)
+		st.Expect(t, google.Queries(), queries+1)
+	}
+}
+
 func checkTXT(t *testing.T, domain string) {
-	r := NewResolver(WithTCPRetry())
+	r := newTestResolver(WithTCPRetry())
 	rrs, err := r.ResolveErr(domain, "TXT")
 	st.Expect(t, err, nil)
 
-	rrs2, err := net.LookupTXT(domain)
+	rrs2, err := lookupTXT(domain)
 	st.Expect(t, err, nil)
 	for _, rr := range rrs2 {
 		exists := false
@@ -321,14 +471,14 @@ func checkTXT(t *testing.T, domain string) {
 var testResolver Resolver
 
 func BenchmarkResolve(b *testing.B) {
-	testResolver = NewResolver()
+	testResolver = newTestResolver()
 	for i := 0; i < b.N; i++ {
 		testResolve()
 	}
 }
 
 func BenchmarkResolveErr(b *testing.B) {
-	testResolver = NewResolver()
+	testResolver = newTestResolver()
 	for i := 0; i < b.N; i++ {
 		testResolveErr()
 	}
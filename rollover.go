@@ -0,0 +1,288 @@
+package bottin
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// keyState is the RFC 5011 state of a trust anchor key.
+type keyState string
+
+const (
+	keyAddPend keyState = "AddPend" // Newly published, trusted once the add hold-down has passed.
+	keyValid   keyState = "Valid"   // Trusted.
+	keyMissing keyState = "Missing" // Trusted, but no longer published.
+	keyRevoked keyState = "Revoked" // Revoked, forgotten once the remove hold-down has passed.
+)
+
+// anchorKey is a key-signing key of a zone tracked with RFC 5011.
+type anchorKey struct {
+	DNSKEY string    `json:"dnskey"` // The key in zone-file format, without the REVOKE flag.
+	State  keyState  `json:"state"`
+	Since  time.Time `json:"since"` // When the key entered its state, which starts the hold-down timers.
+}
+
+// anchorFile is the content of the file of WithTrustAnchorFile: the keys tracked for each zone with
+// a trust anchor.
+type anchorFile struct {
+	Zones map[string][]anchorKey `json:"zones"`
+}
+
+// loadAnchorFile reads the tracked keys from the trust anchor file, and trusts the Valid and Missing
+// ones in place of the configured anchors, even if there are none. A missing file is created at the
+// first refresh. It panics if the file can't be parsed, like the trust anchors.
+func (br *BottinResolver) loadAnchorFile() {
+	br.tracked = make(map[string][]anchorKey)
+	data, err := os.ReadFile(br.anchorFile)
+	if errors.Is(err, fs.ErrNotExist) {
+		return
+	}
+	if err != nil {
+		panic(err)
+	}
+	var file anchorFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		panic(fmt.Errorf("trust anchor file %s: %w", br.anchorFile, err))
+	}
+	for zone, keys := range file.Zones {
+		zone = toLowerFQDN(zone)
+		br.tracked[zone] = keys
+		br.anchors[zone] = trustedKeys(keys) // None when they are all revoked: the zone isn't trusted.
+	}
+}
+
+// saveAnchorFile writes the tracked keys to the trust anchor file, replacing it atomically.
+func (br *BottinResolver) saveAnchorFile() error {
+	data, err := json.MarshalIndent(anchorFile{Zones: br.tracked}, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(br.anchorFile), filepath.Base(br.anchorFile)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), br.anchorFile)
+}
+
+// maintainAnchors refreshes the trust anchors until the resolver is closed.
+func (br *BottinResolver) maintainAnchors() {
+	defer br.workers.Done()
+	for {
+		wait := br.refreshAnchors()
+		select {
+		case <-br.lifetime.Done():
+			return
+		case <-br.clock.After(wait):
+		}
+	}
+}
+
+// refreshAnchors fetches the DNSKEY RRset of each zone with a trust anchor, and updates the state of
+// its key-signing keys with RFC 5011 when a trusted key signs it. It returns when to refresh next
+// (RFC 5011 section 2.3).
+func (br *BottinResolver) refreshAnchors() time.Duration {
+	br.anchorMutex.RLock()
+	var zones []string
+	for zone := range br.anchors {
+		zones = append(zones, zone)
+	}
+	br.anchorMutex.RUnlock()
+	sort.Strings(zones)
+
+	next := 15 * 24 * time.Hour
+	for _, zone := range zones {
+		wait, err := br.refreshAnchor(zone)
+		if err != nil {
+			br.trace(br.lifetime, "trust anchor refresh failed", slog.String("zone", zone), slog.String("error", err.Error()))
+			wait = time.Hour
+		}
+		next = min(next, wait)
+	}
+	return next
+}
+
+// refreshAnchor updates the keys tracked for zone from its current DNSKEY RRset, and returns when to
+// refresh it next.
+func (br *BottinResolver) refreshAnchor(zone string) (time.Duration, error) {
+	ctx, cancel := context.WithTimeout(br.lifetime, br.timeout)
+	defer cancel()
+	resp, _, err := br.descend(ctx, zone, "DNSKEY", 0)
+	if err != nil {
+		return 0, err
+	}
+	rrs, sigs := rrset(resp.Answer, zone, dns.TypeDNSKEY)
+	if len(rrs) == 0 {
+		return 0, fmt.Errorf("no DNSKEY records")
+	}
+	now := br.clock.Now()
+
+	// A key is revoked by publishing it with the REVOKE flag, signing the RRset (RFC 5011 section 2.1).
+	var keys []*dns.DNSKEY
+	revoked := make(map[string]bool)
+	for _, drr := range rrs {
+		key := drr.(*dns.DNSKEY)
+		keys = append(keys, key)
+		if key.Flags&dns.REVOKE != 0 {
+			if _, err := verifyRRset(rrs, sigs, []*dns.DNSKEY{key}, zone, now); err == nil {
+				revoked[keyID(key)] = true
+			}
+		}
+	}
+
+	// Only a DNSKEY RRset signed by a trusted key, or by a trusted key revoking itself, can change
+	// the trust anchors.
+	anchors, _ := br.anchorsFor(zone)
+	var trusted []*dns.DNSKEY
+	for _, key := range keys {
+		if key.Flags&dns.REVOKE == 0 || revoked[keyID(key)] {
+			if trustedKey(key, anchors) {
+				trusted = append(trusted, key)
+			}
+		}
+	}
+	sig, err := verifyRRset(rrs, sigs, trusted, zone, now)
+	if err != nil {
+		return 0, fmt.Errorf("DNSKEY records not signed by a trust anchor: %v", err)
+	}
+
+	br.anchorMutex.Lock()
+	defer br.anchorMutex.Unlock()
+	tracked, known := br.tracked[zone]
+	if !known {
+		// The keys matching the configured anchors are trusted right away.
+		for _, key := range trusted {
+			if key.Flags&dns.SEP != 0 {
+				tracked = append(tracked, anchorKey{DNSKEY: keyString(key), State: keyValid, Since: now})
+			}
+		}
+	}
+	updated, changed := rollKeys(tracked, keys, revoked, now)
+	if changed || !known {
+		for _, key := range updated {
+			br.trace(br.lifetime, "trust anchor", slog.String("zone", zone), slog.String("key", key.DNSKEY), slog.String("state", string(key.State)))
+		}
+		br.tracked[zone] = updated
+		br.anchors[zone] = trustedKeys(updated)
+		br.keys.clear()
+		if err := br.saveAnchorFile(); err != nil {
+			br.trace(br.lifetime, "trust anchor file not saved", slog.String("path", br.anchorFile), slog.String("error", err.Error()))
+		}
+	}
+
+	ttl := time.Duration(sig.OrigTtl) * time.Second
+	expiresIn := time.Unix(int64(sig.Expiration), 0).Sub(now)
+	return max(time.Hour, min(15*24*time.Hour, ttl/2, expiresIn/2)), nil
+}
+
+// rollKeys applies the RFC 5011 state transitions to the tracked keys of a zone, given the keys of
+// its validated DNSKEY RRset and the ones revoked by it. It returns the updated keys, and whether
+// they changed.
+func rollKeys(tracked []anchorKey, published []*dns.DNSKEY, revoked map[string]bool, now time.Time) ([]anchorKey, bool) {
+	seen := make(map[string]*dns.DNSKEY)
+	for _, key := range published {
+		if key.Flags&dns.SEP != 0 && key.Flags&dns.REVOKE == 0 {
+			seen[keyID(key)] = key
+		}
+	}
+
+	var updated []anchorKey
+	changed := false
+	known := make(map[string]bool)
+	for _, k := range tracked {
+		key, err := dns.NewRR(k.DNSKEY)
+		if err != nil {
+			changed = true
+			continue
+		}
+		id := keyID(key.(*dns.DNSKEY))
+		known[id] = true
+		_, present := seen[id]
+		next := k.State
+		switch {
+		case revoked[id] && k.State != keyRevoked:
+			next = keyRevoked
+		case k.State == keyRevoked && !now.Before(k.Since.Add(RemoveHoldDown)):
+			changed = true
+			continue // Removed.
+		case k.State == keyAddPend && !present:
+			changed = true
+			continue // Back to the start, the hold-down restarts if it is published again.
+		case k.State == keyAddPend && !now.Before(k.Since.Add(AddHoldDown)):
+			next = keyValid
+		case k.State == keyValid && !present:
+			next = keyMissing
+		case k.State == keyMissing && present:
+			next = keyValid
+		}
+		if next != k.State {
+			k.State, k.Since = next, now
+			changed = true
+		}
+		updated = append(updated, k)
+	}
+	for _, key := range published {
+		id := keyID(key)
+		if _, ok := seen[id]; ok && !known[id] && !revoked[id] {
+			known[id] = true
+			updated = append(updated, anchorKey{DNSKEY: keyString(key), State: keyAddPend, Since: now})
+			changed = true
+		}
+	}
+	return updated, changed
+}
+
+// trustedKeys returns the keys of tracked that are trust anchors: the Valid and Missing ones.
+func trustedKeys(tracked []anchorKey) []dns.RR {
+	var anchors []dns.RR
+	for _, k := range tracked {
+		if k.State != keyValid && k.State != keyMissing {
+			continue
+		}
+		if key, err := dns.NewRR(k.DNSKEY); err == nil {
+			anchors = append(anchors, key)
+		}
+	}
+	return anchors
+}
+
+// trustedKey reports whether key, revoked or not, matches one of anchors.
+func trustedKey(key *dns.DNSKEY, anchors []dns.RR) bool {
+	unrevoked := dns.Copy(key).(*dns.DNSKEY)
+	unrevoked.Flags &^= dns.REVOKE
+	for _, anchor := range anchors {
+		if matchesAnchor(unrevoked, anchor) {
+			return true
+		}
+	}
+	return false
+}
+
+// keyID identifies a key whether it is revoked or not, which changes its flags and key tag.
+func keyID(key *dns.DNSKEY) string {
+	return fmt.Sprintf("%s %d %s", toLowerFQDN(key.Hdr.Name), key.Algorithm, key.PublicKey)
+}
+
+// keyString returns key in zone-file format, without the REVOKE flag.
+func keyString(key *dns.DNSKEY) string {
+	k := dns.Copy(key).(*dns.DNSKEY)
+	k.Flags &^= dns.REVOKE
+	return k.String()
+}
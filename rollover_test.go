@@ -0,0 +1,272 @@
+package bottin
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/nbio/st"
+
+	"github.com/kakwa/bottin/bottintest"
+)
+
+func TestRollKeys(t *testing.T) {
+	now := time.Now()
+	key := func() *dns.DNSKEY {
+		k, err := bottintest.NewKey(".", true)
+		st.Assert(t, err, nil)
+		return k.DNSKEY
+	}
+	a, b := key(), key()
+	tracked := func(k *dns.DNSKEY, state keyState, since time.Time) anchorKey {
+		return anchorKey{DNSKEY: keyString(k), State: state, Since: since}
+	}
+
+	tests := []struct {
+		name      string
+		tracked   []anchorKey
+		published []*dns.DNSKEY
+		revoked   *dns.DNSKEY
+		states    []keyState
+		changed   bool
+	}{
+		{"unchanged", []anchorKey{tracked(a, keyValid, now)}, []*dns.DNSKEY{a}, nil, []keyState{keyValid}, false},
+		{"new key", []anchorKey{tracked(a, keyValid, now)}, []*dns.DNSKEY{a, b}, nil, []keyState{keyValid, keyAddPend}, true},
+		{"holding down", []anchorKey{tracked(a, keyValid, now), tracked(b, keyAddPend, now.Add(-AddHoldDown+time.Hour))}, []*dns.DNSKEY{a, b}, nil, []keyState{keyValid, keyAddPend}, false},
+		{"held down", []anchorKey{tracked(a, keyValid, now), tracked(b, keyAddPend, now.Add(-AddHoldDown))}, []*dns.DNSKEY{a, b}, nil, []keyState{keyValid, keyValid}, true},
+		{"pending key removed", []anchorKey{tracked(a, keyValid, now), tracked(b, keyAddPend, now)}, []*dns.DNSKEY{a}, nil, []keyState{keyValid}, true},
+		{"missing", []anchorKey{tracked(a, keyValid, now), tracked(b, keyValid, now)}, []*dns.DNSKEY{a}, nil, []keyState{keyValid, keyMissing}, true},
+		{"back", []anchorKey{tracked(a, keyValid, now), tracked(b, keyMissing, now)}, []*dns.DNSKEY{a, b}, nil, []keyState{keyValid, keyValid}, true},
+		{"revoked", []anchorKey{tracked(a, keyValid, now), tracked(b, keyValid, now)}, []*dns.DNSKEY{a}, b, []keyState{keyValid, keyRevoked}, true},
+		{"revoked unknown", []anchorKey{tracked(a, keyValid, now)}, []*dns.DNSKEY{a}, b, []keyState{keyValid}, false},
+		{"revoked kept", []anchorKey{tracked(a, keyValid, now), tracked(b, keyRevoked, now.Add(-time.Hour))}, []*dns.DNSKEY{a}, nil, []keyState{keyValid, keyRevoked}, false},
+		{"revoked removed", []anchorKey{tracked(a, keyValid, now), tracked(b, keyRevoked, now.Add(-RemoveHoldDown))}, []*dns.DNSKEY{a}, nil, []keyState{keyValid}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			revoked := make(map[string]bool)
+			if tt.revoked != nil {
+				revoked[keyID(tt.revoked)] = true
+			}
+			updated, changed := rollKeys(tt.tracked, tt.published, revoked, now)
+			st.Expect(t, changed, tt.changed)
+			var states []keyState
+			for _, k := range updated {
+				states = append(states, k.State)
+			}
+			st.Expect(t, states, tt.states)
+		})
+	}
+}
+
+func TestKeyID(t *testing.T) {
+	k, err := bottintest.NewKey(".", true)
+	st.Assert(t, err, nil)
+	id, tag := keyID(k.DNSKEY), k.DNSKEY.KeyTag()
+	k.Revoke()
+	st.Expect(t, keyID(k.DNSKEY), id)
+	st.Reject(t, k.DNSKEY.KeyTag(), tag)
+	st.Expect(t, keyString(k.DNSKEY) == k.DNSKEY.String(), false)
+}
+
+// rolloverNetwork is a simulated hierarchy whose root zone is re-signed with different keys, and
+// the fake clock of the resolvers maintaining its trust anchors in path.
+type rolloverNetwork struct {
+	*bottintest.Network
+	t          *testing.T
+	clock      *bottintest.Clock
+	path       string
+	exampleKey *bottintest.Key
+	mangle     func(resp *dns.Msg) // Alters the responses of the root zone signed next.
+}
+
+// rolloverValidity is the validity of the signatures of the rollover tests, which must outlive the
+// hold-down timers of the fake clock.
+var rolloverValidity = AddHoldDown + 30*24*time.Hour
+
+func newRolloverNetwork(t *testing.T) *rolloverNetwork {
+	exampleKey, err := bottintest.NewKey("example.", true)
+	st.Assert(t, err, nil)
+	example, err := bottintest.NewServer(testSignedZone)
+	st.Assert(t, err, nil)
+	example.Validity = rolloverValidity
+	st.Assert(t, example.Sign("example.", exampleKey), nil)
+
+	n := &rolloverNetwork{
+		Network:    bottintest.NewNetwork(),
+		t:          t,
+		clock:      bottintest.NewClock(time.Now()),
+		path:       filepath.Join(t.TempDir(), "root.json"),
+		exampleKey: exampleKey,
+	}
+	n.Add(example, "192.0.2.1")
+	return n
+}
+
+// signRoot serves the root zone signed with keys.
+func (n *rolloverNetwork) signRoot(keys ...*bottintest.Key) {
+	root, err := bottintest.NewServer(testSignedRootZone + n.exampleKey.DS().String() + "\n")
+	st.Assert(n.t, err, nil)
+	root.Validity = rolloverValidity
+	root.Mangle = n.mangle
+	st.Assert(n.t, root.Sign(".", keys...), nil)
+	n.Add(root, rootHintAddrs()...)
+}
+
+func (n *rolloverNetwork) resolver(anchor string) *BottinResolver {
+	return NewResolver(WithExchanger(n), WithClock(n.clock), WithCacheOptions(WithCleanupInterval(0)),
+		WithTrustAnchors(anchor), WithTrustAnchorFile(n.path))
+}
+
+// states returns the states of the root keys tracked by r, by key tag.
+func (n *rolloverNetwork) states(r *BottinResolver) map[uint16]keyState {
+	r.anchorMutex.RLock()
+	defer r.anchorMutex.RUnlock()
+	states := make(map[uint16]keyState)
+	for _, k := range r.tracked["."] {
+		key, err := dns.NewRR(k.DNSKEY)
+		st.Assert(n.t, err, nil)
+		states[key.(*dns.DNSKEY).KeyTag()] = k.State
+	}
+	return states
+}
+
+// advance advances the clock by d once the trust anchors are refreshed, and waits for the refresh
+// that follows.
+func (n *rolloverNetwork) advance(d time.Duration) {
+	for n.clock.Waiters() == 0 {
+		time.Sleep(time.Millisecond) // Until the refresh is done.
+	}
+	n.clock.Advance(d)
+	for n.clock.Waiters() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func newRootKeys(t *testing.T) (ksk1, ksk2, zsk *bottintest.Key) {
+	ksk1, err := bottintest.NewKey(".", true)
+	st.Assert(t, err, nil)
+	ksk2, err = bottintest.NewKey(".", true)
+	st.Assert(t, err, nil)
+	zsk, err = bottintest.NewKey(".", false)
+	st.Assert(t, err, nil)
+	return ksk1, ksk2, zsk
+}
+
+// TestTrustAnchorRollover rolls the root KSK over with RFC 5011: a new KSK is published, trusted
+// after the add hold-down, and the old one is then revoked.
+func TestTrustAnchorRollover(t *testing.T) {
+	ksk1, ksk2, zsk := newRootKeys(t)
+	n := newRolloverNetwork(t)
+	n.signRoot(ksk1, zsk)
+
+	r := n.resolver(ksk1.DS().String())
+	n.advance(0) // Waits for the first refresh.
+	st.Expect(t, n.states(r), map[uint16]keyState{ksk1.DNSKEY.KeyTag(): keyValid})
+	_, err := os.Stat(n.path)
+	st.Expect(t, err, nil)
+
+	n.signRoot(ksk1, ksk2, zsk)
+	n.advance(time.Hour) // Half the TTL of the DNSKEY records, but at least an hour.
+	st.Expect(t, n.states(r), map[uint16]keyState{ksk1.DNSKEY.KeyTag(): keyValid, ksk2.DNSKEY.KeyTag(): keyAddPend})
+	n.advance(AddHoldDown - time.Hour)
+	st.Expect(t, n.states(r), map[uint16]keyState{ksk1.DNSKEY.KeyTag(): keyValid, ksk2.DNSKEY.KeyTag(): keyAddPend})
+	n.advance(time.Hour)
+	st.Expect(t, n.states(r), map[uint16]keyState{ksk1.DNSKEY.KeyTag(): keyValid, ksk2.DNSKEY.KeyTag(): keyValid})
+
+	tag1 := ksk1.DNSKEY.KeyTag()
+	ksk1.Revoke()
+	n.signRoot(ksk1, ksk2, zsk)
+	n.advance(time.Hour)
+	st.Expect(t, n.states(r), map[uint16]keyState{tag1: keyRevoked, ksk2.DNSKEY.KeyTag(): keyValid})
+	rrs, err := r.ResolveErr("www.example", "A")
+	st.Expect(t, err, nil)
+	st.Expect(t, rrs.Security, Secure)
+	st.Expect(t, r.Close(), nil)
+
+	// A resolver started with the file trusts the new key, not the configured anchor.
+	r = n.resolver("")
+	defer r.Close()
+	anchors, _ := r.anchorsFor(".")
+	st.Expect(t, len(anchors), 1)
+	st.Expect(t, anchors[0].(*dns.DNSKEY).KeyTag(), ksk2.DNSKEY.KeyTag())
+	rrs, err = r.ResolveErr("www.example", "A")
+	st.Expect(t, err, nil)
+	st.Expect(t, rrs.Security, Secure)
+}
+
+// TestTrustAnchorEarlyRevocation revokes the only trusted root KSK before its successor is trusted:
+// the revocation, signed by the revoked key itself, is recorded, and the root is no longer trusted,
+// even after a restart with the revoked key as configured anchor.
+func TestTrustAnchorEarlyRevocation(t *testing.T) {
+	ksk1, ksk2, zsk := newRootKeys(t)
+	n := newRolloverNetwork(t)
+	n.signRoot(ksk1, ksk2, zsk)
+	anchor := ksk1.DS().String()
+
+	r := n.resolver(anchor)
+	n.advance(0)
+	st.Expect(t, n.states(r), map[uint16]keyState{ksk1.DNSKEY.KeyTag(): keyValid, ksk2.DNSKEY.KeyTag(): keyAddPend})
+
+	tag1 := ksk1.DNSKEY.KeyTag()
+	ksk1.Revoke()
+	n.signRoot(ksk1, ksk2, zsk)
+	n.advance(time.Hour)
+	st.Expect(t, n.states(r), map[uint16]keyState{tag1: keyRevoked, ksk2.DNSKEY.KeyTag(): keyAddPend})
+	anchors, ok := r.anchorsFor(".")
+	st.Expect(t, ok, true)
+	st.Expect(t, len(anchors), 0)
+	_, err := r.ResolveErr("www.example", "A")
+	var bogus *BogusError
+	st.Expect(t, errors.As(err, &bogus), true)
+	st.Expect(t, r.Close(), nil)
+
+	r = n.resolver(anchor)
+	defer r.Close()
+	anchors, _ = r.anchorsFor(".")
+	st.Expect(t, len(anchors), 0)
+	_, err = r.ResolveErr("www.example", "A")
+	st.Expect(t, errors.As(err, &bogus), true)
+}
+
+// TestTrustAnchorNoKeys refreshes the trust anchors from a DNSKEY response holding the signatures
+// of the root keys, but not the keys: the refresh fails, and the tracked keys stay as they were.
+func TestTrustAnchorNoKeys(t *testing.T) {
+	ksk, _, zsk := newRootKeys(t)
+	n := newRolloverNetwork(t)
+	n.signRoot(ksk, zsk)
+	r := n.resolver(ksk.DS().String())
+	defer r.Close()
+	n.advance(0)
+	st.Expect(t, n.states(r), map[uint16]keyState{ksk.DNSKEY.KeyTag(): keyValid})
+
+	n.mangle = func(resp *dns.Msg) {
+		if resp.Question[0].Qtype != dns.TypeDNSKEY {
+			return
+		}
+		var sigs []dns.RR
+		for _, rr := range resp.Answer {
+			if rr.Header().Rrtype == dns.TypeRRSIG {
+				sigs = append(sigs, rr)
+			}
+		}
+		resp.Answer = sigs
+	}
+	n.signRoot(ksk, zsk)
+	n.advance(time.Hour)
+	st.Expect(t, n.states(r), map[uint16]keyState{ksk.DNSKEY.KeyTag(): keyValid})
+	n.advance(time.Hour) // A failed refresh is retried an hour later.
+	st.Expect(t, n.states(r), map[uint16]keyState{ksk.DNSKEY.KeyTag(): keyValid})
+}
+
+func TestTrustAnchorFileCorrupt(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "root.json")
+	st.Assert(t, os.WriteFile(path, []byte("{"), 0o600), nil)
+	defer func() {
+		st.Reject(t, recover(), nil)
+	}()
+	NewResolver(WithExchanger(newTestNetwork()), WithTrustAnchorFile(path))
+}
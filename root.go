@@ -14,13 +14,17 @@ import (
 var root string
 
 func (br *BottinResolver) initRoot() {
-	zp := dns.NewZoneParser(strings.NewReader(root), "", "")
+	hints := root
+	if br.rootHints != "" {
+		hints = br.rootHints
+	}
+	zp := dns.NewZoneParser(strings.NewReader(hints), "", "")
 
 	for drr, ok := zp.Next(); ok; drr, ok = zp.Next() {
-		rr, ok := convertRR(drr, false)
+		rr, ok := convertRR(drr, false, br.clock.Now())
 		if ok {
 			oldRRs, _ := br.root.Get(rr.Key())
-			br.root.Set(rr.Key(), append(oldRRs, rr))
+			br.root.SetPinned(rr.Key(), append(oldRRs, rr))
 		}
 	}
 
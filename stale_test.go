@@ -0,0 +1,89 @@
+package bottin
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/kakwa/bottin/bottintest"
+	"github.com/nbio/st"
+)
+
+// expiredGoogleA caches an A record for google.com in r, and lets it expire.
+func expiredGoogleA(r *BottinResolver, clock *bottintest.Clock) {
+	r.cache.Set("google.com.|A", []RR{{Name: "google.com.", Type: "A", Value: "192.0.2.14", TTL: time.Minute}})
+	clock.Advance(2 * time.Minute)
+}
+
+func TestServeStaleOnFailure(t *testing.T) {
+	n := newTestNetwork()
+	n.Server("216.239.32.10").Drop = true
+	clock := bottintest.NewClock(time.Now())
+	r := NewResolver(WithExchanger(n), WithClock(clock), WithExpiry(), WithTimeout(200*time.Millisecond), WithServeStale(time.Hour, 0))
+	expiredGoogleA(r, clock)
+
+	rrs, err := r.ResolveErr("google.com", "A")
+	st.Expect(t, err, nil)
+	st.Expect(t, rrs.AnswerRRs[0], RR{Name: "google.com.", Type: "A", Value: "192.0.2.14", TTL: StaleTTL, Expiry: rrs.AnswerRRs[0].Expiry})
+	st.Expect(t, count(rrs.AnswerRRs, func(rr RR) bool { return rr.Type == "A" }), 1)
+}
+
+func TestServeStaleDisabled(t *testing.T) {
+	n := newTestNetwork()
+	n.Server("216.239.32.10").Drop = true
+	clock := bottintest.NewClock(time.Now())
+	r := NewResolver(WithExchanger(n), WithClock(clock), WithExpiry(), WithTimeout(200*time.Millisecond))
+	expiredGoogleA(r, clock)
+
+	_, err := r.ResolveErr("google.com", "A")
+	st.Expect(t, err != nil, true)
+}
+
+func TestServeStaleClientTimeout(t *testing.T) {
+	n := newTestNetwork()
+	n.Server("216.239.32.10").RTT = 100 * time.Millisecond
+	clock := bottintest.NewClock(time.Now())
+	r := NewResolver(WithExchanger(n), WithClock(clock), WithExpiry(), WithServeStale(time.Hour, 10*time.Millisecond))
+	expiredGoogleA(r, clock)
+
+	start := time.Now()
+	rrs, err := r.ResolveErr("google.com", "A")
+	st.Expect(t, err, nil)
+	st.Expect(t, time.Since(start) < 100*time.Millisecond, true)
+	st.Expect(t, rrs.AnswerRRs[0].Value, "192.0.2.14")
+
+	// The resolution carries on in the background, and refreshes the cache.
+	time.Sleep(200 * time.Millisecond)
+	fresh, ok := r.cache.Get("google.com.|A")
+	st.Expect(t, ok, true)
+	st.Expect(t, fresh[0].Value, "142.250.72.14")
+}
+
+func TestServeStaleRecheck(t *testing.T) {
+	n := newTestNetwork()
+	google := n.Server("216.239.32.10")
+	google.Drop = true
+	clock := bottintest.NewClock(time.Now())
+	r := NewResolver(WithExchanger(n), WithClock(clock), WithExpiry(), WithTimeout(200*time.Millisecond), WithServeStale(time.Hour, 0))
+	expiredGoogleA(r, clock)
+
+	// Without a deadline of its own, the client waits for the refresh to fail.
+	rrs, err := r.ResolveCtx(context.Background(), "google.com", "A")
+	st.Expect(t, err, nil)
+	st.Expect(t, rrs.AnswerRRs[0].Value, "192.0.2.14")
+	queries := google.Queries()
+	st.Expect(t, queries > 0, true)
+
+	// Within the failure recheck timer, the stale records are served without querying again.
+	rrs, err = r.ResolveErr("google.com", "A")
+	st.Expect(t, err, nil)
+	st.Expect(t, rrs.AnswerRRs[0].Value, "192.0.2.14")
+	st.Expect(t, google.Queries(), queries)
+
+	clock.Advance(StaleRecheck)
+	google.Drop = false
+	rrs, err = r.ResolveErr("google.com", "A")
+	st.Expect(t, err, nil)
+	st.Expect(t, rrs.AnswerRRs[0].Value, "142.250.72.14")
+	st.Expect(t, google.Queries() > queries, true)
+}
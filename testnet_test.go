@@ -0,0 +1,238 @@
+package bottin
+
+import (
+	"strings"
+
+	"github.com/kakwa/bottin/bottintest"
+	"github.com/miekg/dns"
+)
+
+// The simulated hierarchy served by newTestNetwork, mirroring the parts of the real DNS the tests
+// rely on.
+const (
+	testRootZone = `
+.                       86400   IN SOA a.root-servers.net. nstld.verisign-grs.com. 1 1800 900 604800 86400
+.                       518400  IN NS  a.root-servers.net.
+com.                    172800  IN NS  a.gtld-servers.net.
+com.                    172800  IN NS  b.gtld-servers.net.
+net.                    172800  IN NS  a.gtld-servers.net.
+net.                    172800  IN NS  b.gtld-servers.net.
+uk.                     172800  IN NS  nsa.nic.uk.
+in-addr.arpa.           172800  IN NS  a.in-addr-servers.arpa.
+a.gtld-servers.net.     172800  IN A   192.5.6.30
+b.gtld-servers.net.     172800  IN A   192.33.14.30
+nsa.nic.uk.             172800  IN A   156.154.100.3
+a.in-addr-servers.arpa. 172800  IN A   199.180.182.53
+`
+	testComZone = `
+com.                    900     IN SOA a.gtld-servers.net. nstld.verisign-grs.com. 1 1800 900 604800 900
+com.                    172800  IN NS  a.gtld-servers.net.
+google.com.             172800  IN NS  ns1.google.com.
+google.com.             172800  IN NS  ns2.google.com.
+google.com.             172800  IN NS  ns3.google.com.
+google.com.             172800  IN NS  ns4.google.com.
+ns1.google.com.         172800  IN A   216.239.32.10
+ns2.google.com.         172800  IN A   216.239.34.10
+ns3.google.com.         172800  IN A   216.239.36.10
+ns4.google.com.         172800  IN A   216.239.38.10
+apple.com.              172800  IN NS  a.ns.apple-dns.net.
+apple.com.              172800  IN NS  b.ns.apple-dns.net.
+cloudflare.com.         172800  IN NS  ns3.cloudflare.com.
+cloudflare.com.         172800  IN NS  ns4.cloudflare.com.
+ns3.cloudflare.com.     172800  IN A   162.159.0.33
+ns4.cloudflare.com.     172800  IN A   162.159.1.33
+herokuapp.com.          172800  IN NS  ns1.herokuapp.com.
+ns1.herokuapp.com.      172800  IN A   192.0.2.80
+`
+	testNetZone = `
+net.                    900     IN SOA a.gtld-servers.net. nstld.verisign-grs.com. 1 1800 900 604800 900
+net.                    172800  IN NS  a.gtld-servers.net.
+apple-dns.net.          172800  IN NS  a.ns.apple-dns.net.
+a.ns.apple-dns.net.     172800  IN A   17.253.200.1
+b.ns.apple-dns.net.     172800  IN A   17.253.207.1
+arin.net.               172800  IN NS  ns1.arin.net.
+ns1.arin.net.           172800  IN A   199.212.0.63
+cdn-provider.net.       172800  IN NS  ns1.cdn-provider.net.
+ns1.cdn-provider.net.   172800  IN A   192.0.2.90
+`
+	testUKZone = `
+uk.                     10800   IN SOA nsa.nic.uk. hostmaster.nominet.org.uk. 1 900 300 2419200 10800
+uk.                     172800  IN NS  nsa.nic.uk.
+baz.co.uk.              172800  IN NS  ns1.baz.co.uk.
+baz.co.uk.              172800  IN NS  ns2.baz.co.uk.
+ns1.baz.co.uk.          172800  IN A   192.0.2.53
+ns2.baz.co.uk.          172800  IN A   192.0.2.54
+`
+	testInAddrZone = `
+in-addr.arpa.           3600    IN SOA b.in-addr-servers.arpa. nstld.iana.org. 1 1800 900 604800 3600
+in-addr.arpa.           172800  IN NS  a.in-addr-servers.arpa.
+8.in-addr.arpa.         86400   IN NS  ns1.arin.net.
+217.172.in-addr.arpa.   86400   IN NS  ns1.google.com.
+217.172.in-addr.arpa.   86400   IN NS  ns2.google.com.
+`
+	testArinZones = `
+arin.net.               3600    IN SOA ns1.arin.net. hostmaster.arin.net. 1 1800 900 604800 3600
+arin.net.               86400   IN NS  ns1.arin.net.
+ns1.arin.net.           86400   IN A   199.212.0.63
+`
+	test8InAddrZone = `
+8.in-addr.arpa.         3600    IN SOA ns1.arin.net. hostmaster.arin.net. 1 1800 900 604800 3600
+8.in-addr.arpa.         86400   IN NS  ns1.arin.net.
+8.8.8.in-addr.arpa.     86400   IN NS  ns1.google.com.
+8.8.8.in-addr.arpa.     86400   IN NS  ns2.google.com.
+`
+	testGoogleZone = `
+google.com.             60      IN SOA ns1.google.com. dns-admin.google.com. 1 900 900 1800 60
+google.com.             345600  IN NS  ns1.google.com.
+google.com.             345600  IN NS  ns2.google.com.
+google.com.             345600  IN NS  ns3.google.com.
+google.com.             345600  IN NS  ns4.google.com.
+google.com.             300     IN A   142.250.72.14
+google.com.             300     IN MX  10 smtp.google.com.
+google.com.             3600    IN TXT "v=spf1 include:_spf.google.com ~all"
+google.com.             3600    IN TXT "google-site-verification=wD8N7i1JTNTkezJ49swvWW48f8_9xveREV4oB-0Hf5o"
+google.com.             3600    IN TXT "google-site-verification=TV9-DBe4R80X4v0M4U_bd_J9cpOJM0nikft0jAgjmsQ"
+google.com.             3600    IN TXT "docusign=05958488-4752-4ef2-95eb-aa7ba8a3bd0e"
+google.com.             3600    IN TXT "docusign=1b0a6754-49b1-4db5-8540-d2c12664b289"
+google.com.             3600    IN TXT "facebook-domain-verification=22rm551cu4k0ab0bxsw536tlds4h95"
+google.com.             3600    IN TXT "globalsign-smime-dv=CDYX+XFHUw2wml6/Gb8+59BsH31KzUr6c1l2BPvqKX8="
+google.com.             3600    IN TXT "MS=E4A68B9AB2BB9670BCE15412F62916164C0B20BB"
+google.com.             3600    IN TXT "apple-domain-verification=30afIBcvSuDV2PLX"
+google.com.             3600    IN TXT "onetrust-domain-verification=de01ed21f2fa4d8781cbc3ffb89cf4ef"
+google.com.             3600    IN TXT "cisco-ci-domain-verification=479146de172eb01ddee38b1a455ab9e8bb51542ddd7f1fa298557dfa7b22d963"
+google.com.             3600    IN TXT "webexdomainverification.8YX6G=6e6922db-e3e6-4a36-904e-a805c28087fa"
+google.com.             3600    IN TXT "atlassian-domain-verification=5YjTmWmjI92ewqkx2oXmBaD60Td9zWon9r6eakvHX6B77zzkFQto8PQ9QsKnbf4I"
+google.com.             3600    IN TXT "adobe-idp-site-verification=4b05a2f5-ae22-4a5c-8e74-6bb4c8e3ae4f"
+google.com.             3600    IN TXT "zoom-domain-verification=4a4a6e8b-2b6c-4f7e-9e1c-1a2b3c4d5e6f"
+google.com.             3600    IN TXT "stripe-verification=8c2ef1d9a2b5c8f1e4d7a0b3c6f9e2d5a8b1c4f7e0d3a6b9c2f5e8d1a4b7c0f3"
+google.com.             3600    IN TXT "miro-verification=1a8b2f9c7d6e5f4a3b2c1d0e9f8a7b6c5d4e3f2a"
+google.com.             3600    IN TXT "slack-domain-verification=Ap0p7b2jXyVzJ3kT9wQ1rS5uL8mN4cH6gF0dE2aB"
+google.com.             3600    IN TXT "canva-site-verification=QmF5cGFzc2VkLWV4YW1wbGUtdmVyaWZpY2F0aW9u"
+google.com.             3600    IN TXT "hubspot-developer-verification=OTQ0NzE2YzEtNmQ0Yy00ZTEzLWE5NjUtODc0ZjA3YjA2ZjZk"
+ns1.google.com.         345600  IN A   216.239.32.10
+ns2.google.com.         345600  IN A   216.239.34.10
+ns3.google.com.         345600  IN A   216.239.36.10
+ns4.google.com.         345600  IN A   216.239.38.10
+translate.google.com.   300     IN CNAME www3.l.google.com.
+www3.l.google.com.      300     IN A   142.250.72.46
+`
+	testGoogleReverseZones = `
+8.8.8.in-addr.arpa.     3600    IN SOA ns1.google.com. dns-admin.google.com. 1 900 900 1800 60
+8.8.8.in-addr.arpa.     86400   IN NS  ns1.google.com.
+8.8.8.8.in-addr.arpa.   86400   IN PTR dns.google.
+`
+	testGoogleReverseZones2 = `
+217.172.in-addr.arpa.   3600    IN SOA ns1.google.com. dns-admin.google.com. 1 900 900 1800 60
+217.172.in-addr.arpa.   86400   IN NS  ns1.google.com.
+99.17.217.172.in-addr.arpa. 86400 IN PTR lax17s49-in-f3.1e100.net.
+99.17.217.172.in-addr.arpa. 86400 IN PTR lax17s49-in-f99.1e100.net.
+`
+	testAppleZones = `
+apple.com.              3600    IN SOA a.ns.apple-dns.net. hostmaster.apple.com. 1 1800 900 2016000 3600
+apple.com.              86400   IN NS  a.ns.apple-dns.net.
+apple.com.              86400   IN NS  b.ns.apple-dns.net.
+apple.com.              3600    IN A   17.253.144.10
+cdn.apple.com.          3600    IN CNAME apple.cdn-provider.net.
+`
+	testAppleDNSZone = `
+apple-dns.net.          3600    IN SOA a.ns.apple-dns.net. hostmaster.apple.com. 1 1800 900 2016000 3600
+apple-dns.net.          86400   IN NS  a.ns.apple-dns.net.
+a.ns.apple-dns.net.     86400   IN A   17.253.200.1
+b.ns.apple-dns.net.     86400   IN A   17.253.207.1
+`
+	testCDNZone = `
+cdn-provider.net.       300     IN SOA ns1.cdn-provider.net. hostmaster.cdn-provider.net. 1 1800 900 604800 300
+cdn-provider.net.       300     IN NS  ns1.cdn-provider.net.
+ns1.cdn-provider.net.   300     IN A   192.0.2.90
+apple.cdn-provider.net. 60      IN CNAME edge.cdn-provider.net.
+edge.cdn-provider.net.  60      IN A   192.0.2.91
+edge.cdn-provider.net.  60      IN A   192.0.2.92
+`
+	testCloudflareZone = `
+cloudflare.com.         300     IN SOA ns3.cloudflare.com. dns.cloudflare.com. 1 10000 2400 604800 300
+cloudflare.com.         86400   IN NS  ns3.cloudflare.com.
+cloudflare.com.         86400   IN NS  ns4.cloudflare.com.
+cloudflare.com.         300     IN A   104.16.132.229
+cloudflare.com.         300     IN TXT "v=spf1 ip4:199.15.212.0/22 include:_spf.google.com ~all"
+cloudflare.com.         300     IN TXT "google-site-verification=ZdlQZLBBAPkxeFTCM1rpiB_ibtGff_JF5KllNKwDR9I"
+cloudflare.com.         300     IN TXT "docusign=4c6ab6ce-3dd4-4b21-9f3e-3bbf7e0f7b5f"
+ns3.cloudflare.com.     86400   IN A   162.159.0.33
+ns4.cloudflare.com.     86400   IN A   162.159.1.33
+`
+	testHerokuZone = `
+herokuapp.com.          60      IN SOA ns1.herokuapp.com. hostmaster.heroku.com. 1 1800 900 604800 60
+herokuapp.com.          86400   IN NS  ns1.herokuapp.com.
+ns1.herokuapp.com.      86400   IN A   192.0.2.80
+us-east-1-a.route.herokuapp.com. 60 IN A 192.0.2.81
+`
+	testBazZone = `
+baz.co.uk.              3600    IN SOA ns1.baz.co.uk. hostmaster.baz.co.uk. 1 1800 900 604800 3600
+baz.co.uk.              3600    IN NS  ns1.baz.co.uk.
+baz.co.uk.              3600    IN NS  ns2.baz.co.uk.
+baz.co.uk.              3600    IN MX  10 mail.baz.co.uk.
+ns1.baz.co.uk.          3600    IN A   192.0.2.53
+ns2.baz.co.uk.          3600    IN A   192.0.2.54
+`
+)
+
+// testZones lists every zone of the simulated hierarchy.
+var testZones = []string{
+	testRootZone, testComZone, testNetZone, testUKZone, testInAddrZone, testArinZones, test8InAddrZone,
+	testGoogleZone, testGoogleReverseZones, testGoogleReverseZones2, testAppleZones, testAppleDNSZone,
+	testCDNZone, testCloudflareZone, testHerokuZone, testBazZone,
+}
+
+// newTestNetwork returns a simulated hierarchy whose root servers answer at the addresses of the
+// embedded root hints.
+func newTestNetwork() *bottintest.Network {
+	n := bottintest.NewNetwork()
+	add := func(addrs []string, zones ...string) {
+		srv, err := bottintest.NewServer(zones...)
+		if err != nil {
+			panic(err)
+		}
+		n.Add(srv, addrs...)
+	}
+	add(rootHintAddrs(), testRootZone)
+	add([]string{"192.5.6.30", "192.33.14.30"}, testComZone, testNetZone)
+	add([]string{"156.154.100.3"}, testUKZone)
+	add([]string{"199.180.182.53"}, testInAddrZone)
+	add([]string{"199.212.0.63"}, testArinZones, test8InAddrZone)
+	add([]string{"216.239.32.10", "216.239.34.10", "216.239.36.10", "216.239.38.10"},
+		testGoogleZone, testGoogleReverseZones, testGoogleReverseZones2)
+	add([]string{"17.253.200.1", "17.253.207.1"}, testAppleZones, testAppleDNSZone)
+	add([]string{"192.0.2.90"}, testCDNZone)
+	add([]string{"162.159.0.33", "162.159.1.33"}, testCloudflareZone)
+	add([]string{"192.0.2.80"}, testHerokuZone)
+	add([]string{"192.0.2.53", "192.0.2.54"}, testBazZone)
+	return n
+}
+
+// rootHintAddrs returns the addresses of the root servers in the embedded root hints.
+func rootHintAddrs() []string {
+	var addrs []string
+	zp := dns.NewZoneParser(strings.NewReader(root), "", "")
+	for drr, ok := zp.Next(); ok; drr, ok = zp.Next() {
+		switch rr := drr.(type) {
+		case *dns.A:
+			addrs = append(addrs, rr.A.String())
+		case *dns.AAAA:
+			addrs = append(addrs, rr.AAAA.String())
+		}
+	}
+	return addrs
+}
+
+// testTXT returns the TXT records of name in the simulated hierarchy.
+func testTXT(name string) []string {
+	var txts []string
+	for _, text := range testZones {
+		zp := dns.NewZoneParser(strings.NewReader(text), "", "")
+		for drr, ok := zp.Next(); ok; drr, ok = zp.Next() {
+			if rr, ok := drr.(*dns.TXT); ok && rr.Hdr.Name == dns.Fqdn(name) {
+				txts = append(txts, strings.Join(rr.Txt, ""))
+			}
+		}
+	}
+	return txts
+}
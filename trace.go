@@ -0,0 +1,142 @@
+package bottin
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// trace records a step of a resolution on the trace logger, if any.
+func (br *BottinResolver) trace(ctx context.Context, step string, attrs ...slog.Attr) {
+	if br.logger == nil {
+		return
+	}
+	br.logger.LogAttrs(ctx, slog.LevelDebug, step, attrs...)
+}
+
+// traceCache records a cache lookup for name/qtype, hit being the kind of entry found, if any.
+func (br *BottinResolver) traceCache(ctx context.Context, name, qtype, hit string) {
+	if hit == "" {
+		br.trace(ctx, "cache miss", slog.String("qname", name), slog.String("qtype", wireType(qtype)))
+		return
+	}
+	br.trace(ctx, "cache hit", slog.String("qname", name), slog.String("qtype", wireType(qtype)), slog.String("entry", hit))
+}
+
+// Hop is an upstream query made during a resolution traced with ResolveTrace.
+type Hop struct {
+	Zone     string        `json:"zone"`               // Zone the server was queried for.
+	Server   string        `json:"server"`             // Name of the nameserver, if known.
+	Addr     string        `json:"addr"`               // IP address of the nameserver.
+	Network  string        `json:"network"`            // udp or tcp.
+	Qname    string        `json:"qname"`              // Name queried.
+	Qtype    string        `json:"qtype"`              // Type queried.
+	Rcode    string        `json:"rcode,omitempty"`    // Response code, empty if no response was received.
+	RTT      time.Duration `json:"rtt"`                // Round trip time of the query.
+	Answer   []RR          `json:"answer,omitempty"`   // Answer section received.
+	Referral []RR          `json:"referral,omitempty"` // NS records of the authority section received.
+	Glue     []RR          `json:"glue,omitempty"`     // Address records of the additional section received.
+	Error    string        `json:"error,omitempty"`    // Error of the query, if it failed.
+}
+
+// Trace is the ordered list of the upstream queries made during a resolution.
+type Trace struct {
+	Hops  []Hop `json:"hops"`
+	mutex sync.Mutex
+}
+
+type traceKey struct{}
+
+// recorder returns the Trace collecting the hops of the resolution of ctx, if any.
+func recorder(ctx context.Context) *Trace {
+	trace, _ := ctx.Value(traceKey{}).(*Trace)
+	return trace
+}
+
+// recordHop adds the query msg sent to nsAddr, and its outcome, to the Trace of ctx, if any.
+func (br *BottinResolver) recordHop(ctx context.Context, zone, nsAddr, network string, msg, resp *dns.Msg, rtt time.Duration, err error) {
+	trace := recorder(ctx)
+	if trace == nil {
+		return
+	}
+	hop := Hop{
+		Zone:    zone,
+		Server:  br.serverName(zone, nsAddr),
+		Addr:    nsAddr,
+		Network: network,
+		Qname:   msg.Question[0].Name,
+		Qtype:   dns.TypeToString[msg.Question[0].Qtype],
+		RTT:     rtt,
+	}
+	if err != nil {
+		hop.Error = err.Error()
+	}
+	if resp != nil {
+		now := br.clock.Now()
+		hop.Rcode = dns.RcodeToString[resp.Rcode]
+		for _, drr := range resp.Answer {
+			if rr, ok := convertRR(drr, true, now); ok {
+				hop.Answer = append(hop.Answer, rr)
+			}
+		}
+		for _, drr := range resp.Ns {
+			if rr, ok := convertRR(drr, true, now); ok && rr.Type == "NS" {
+				hop.Referral = append(hop.Referral, rr)
+			}
+		}
+		for _, drr := range resp.Extra {
+			if rr, ok := convertRR(drr, true, now); ok && (rr.Type == "A" || rr.Type == "AAAA") {
+				hop.Glue = append(hop.Glue, rr)
+			}
+		}
+	}
+	trace.mutex.Lock()
+	defer trace.mutex.Unlock()
+	trace.Hops = append(trace.Hops, hop)
+}
+
+// serverName returns the name of the nameserver of zone at nsAddr, or an empty string if unknown.
+func (br *BottinResolver) serverName(zone, nsAddr string) string {
+	for _, ns := range br.lookup(zone + "|NS") {
+		for _, qtype := range []string{"A", "AAAA"} {
+			for _, rr := range br.lookup(ns.Value + "|" + qtype) {
+				if rr.Value == nsAddr {
+					return ns.Value
+				}
+			}
+		}
+	}
+	return ""
+}
+
+// String formats the trace like dig +trace: the records received from each server, followed by
+// a summary line of the query.
+func (t *Trace) String() string {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	var b strings.Builder
+	for _, hop := range t.Hops {
+		for _, section := range [][]RR{hop.Answer, hop.Referral, hop.Glue} {
+			for _, rr := range section {
+				fmt.Fprintf(&b, "%s\t%d\tIN\t%s\t%s\n", rr.Name, int(rr.TTL/time.Second), rr.Type, rr.Value)
+			}
+		}
+		server := net.JoinHostPort(hop.Addr, "53")
+		if hop.Server != "" {
+			server += "(" + hop.Server + ")"
+		}
+		outcome := hop.Rcode
+		if hop.Error != "" {
+			outcome = "error: " + hop.Error
+		}
+		fmt.Fprintf(&b, ";; %s %s for zone %s from %s over %s: %s in %d ms\n\n",
+			hop.Qname, hop.Qtype, hop.Zone, server, hop.Network, outcome, hop.RTT.Milliseconds())
+	}
+	return b.String()
+}
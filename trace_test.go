@@ -0,0 +1,41 @@
+package bottin
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/nbio/st"
+)
+
+func TestTraceString(t *testing.T) {
+	trace := &Trace{Hops: []Hop{{
+		Zone:     ".",
+		Server:   "a.root-servers.net.",
+		Addr:     "198.41.0.4",
+		Network:  "udp",
+		Qname:    "example.com.",
+		Qtype:    "A",
+		Rcode:    "NOERROR",
+		RTT:      12 * time.Millisecond,
+		Referral: []RR{{Name: "com.", Type: "NS", Value: "a.gtld-servers.net.", TTL: 172800 * time.Second}},
+		Glue:     []RR{{Name: "a.gtld-servers.net.", Type: "A", Value: "192.5.6.30", TTL: 172800 * time.Second}},
+	}, {
+		Zone:    "com.",
+		Addr:    "2001:503:a83e::2:30",
+		Network: "udp",
+		Qname:   "example.com.",
+		Qtype:   "A",
+		Error:   "i/o timeout",
+	}}}
+	st.Expect(t, trace.String(), "com.\t172800\tIN\tNS\ta.gtld-servers.net.\n"+
+		"a.gtld-servers.net.\t172800\tIN\tA\t192.5.6.30\n"+
+		";; example.com. A for zone . from 198.41.0.4:53(a.root-servers.net.) over udp: NOERROR in 12 ms\n\n"+
+		";; example.com. A for zone com. from [2001:503:a83e::2:30]:53 over udp: error: i/o timeout in 0 ms\n\n")
+
+	data, err := json.Marshal(trace)
+	st.Expect(t, err, nil)
+	var decoded Trace
+	st.Expect(t, json.Unmarshal(data, &decoded), nil)
+	st.Expect(t, decoded.Hops, trace.Hops)
+}
@@ -0,0 +1,33 @@
+package bottin
+
+import (
+	"context"
+	"net"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Exchanger sends the query msg to the nameserver at addr (host:port) over network, "udp" or "tcp",
+// and returns its response along with the round trip time. The deadline of ctx bounds the exchange.
+// A BottinResolver sends every upstream query through its Exchanger.
+type Exchanger interface {
+	Exchange(ctx context.Context, msg *dns.Msg, network, addr string) (*dns.Msg, time.Duration, error)
+}
+
+// ClientExchanger is the default Exchanger, sending queries with a miekg/dns Client.
+type ClientExchanger struct {
+	Dialer *net.Dialer // Dialer used for outbound sockets, nil for the default one.
+}
+
+// Exchange implements Exchanger.
+func (ce *ClientExchanger) Exchange(ctx context.Context, msg *dns.Msg, network, addr string) (*dns.Msg, time.Duration, error) {
+	client := &dns.Client{
+		Net:    network,
+		Dialer: ce.Dialer,
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		client.Timeout = time.Until(deadline)
+	}
+	return client.ExchangeContext(ctx, msg, addr)
+}
@@ -1,23 +1,27 @@
 package bottin
 
 import (
+	"context"
 	"github.com/miekg/dns"
+	"math/rand/v2"
 	"strings"
 	"time"
 )
 
-// calculateExpiry calculates the expiry time of an RR.
-func calculateExpiry(drr dns.RR) (time.Duration, time.Time) {
+// calculateExpiry calculates the expiry time of an RR received at now.
+func calculateExpiry(drr dns.RR, now time.Time) (time.Duration, time.Time) {
 	ttl := time.Second * time.Duration(drr.Header().Ttl)
-	expiry := time.Now().Add(ttl)
+	expiry := now.Add(ttl)
 	return ttl, expiry
 }
 
-func convertRR(drr dns.RR, expire bool) (RR, bool) {
+// convertRR converts drr, received at now, to an RR. Its TTL and expiry are left zero unless expire
+// is set.
+func convertRR(drr dns.RR, expire bool, now time.Time) (RR, bool) {
 	var ttl time.Duration
 	var expiry time.Time
 	if expire {
-		ttl, expiry = calculateExpiry(drr)
+		ttl, expiry = calculateExpiry(drr, now)
 	}
 	switch t := drr.(type) {
 	case *dns.SOA:
@@ -26,6 +30,8 @@ func convertRR(drr dns.RR, expire bool) (RR, bool) {
 		return RR{toLowerFQDN(t.Hdr.Name), "NS", toLowerFQDN(t.Ns), ttl, expiry}, true
 	case *dns.CNAME:
 		return RR{toLowerFQDN(t.Hdr.Name), "CNAME", toLowerFQDN(t.Target), ttl, expiry}, true
+	case *dns.DNAME:
+		return RR{toLowerFQDN(t.Hdr.Name), "DNAME", toLowerFQDN(t.Target), ttl, expiry}, true
 	case *dns.A:
 		return RR{toLowerFQDN(t.Hdr.Name), "A", t.A.String(), ttl, expiry}, true
 	case *dns.AAAA:
@@ -49,6 +55,58 @@ func parent(name string) (string, bool) {
 	return toLowerFQDN(strings.Join(labels[1:], ".")), true
 }
 
+// randomCase returns name with the case of each letter picked at random, so that spoofed responses
+// must also guess it (DNS 0x20).
+func randomCase(name string) string {
+	b := []byte(name)
+	for i, c := range b {
+		if 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' {
+			if rand.IntN(2) == 0 {
+				b[i] = c | 0x20
+			} else {
+				b[i] = c &^ 0x20
+			}
+		}
+	}
+	return string(b)
+}
+
 func toLowerFQDN(name string) string {
 	return dns.Fqdn(strings.ToLower(name))
 }
+
+// wireType returns the query type sent on the wire for qtype, an empty qtype meaning A.
+func wireType(qtype string) string {
+	if qtype == "" {
+		return "A"
+	}
+	return qtype
+}
+
+type pendingKey struct{}
+
+// pending is the chain of name|type keys being resolved on the current resolution path.
+type pending struct {
+	key  string
+	next *pending
+}
+
+// withPending records key on the resolution path of ctx.
+// It returns false if key is already being resolved, which means a dependency loop.
+func withPending(ctx context.Context, key string) (context.Context, bool) {
+	if isPending(ctx, key) {
+		return ctx, false
+	}
+	head, _ := ctx.Value(pendingKey{}).(*pending)
+	return context.WithValue(ctx, pendingKey{}, &pending{key: key, next: head}), true
+}
+
+// isPending reports whether key is being resolved on the resolution path of ctx.
+func isPending(ctx context.Context, key string) bool {
+	for p, _ := ctx.Value(pendingKey{}).(*pending); p != nil; p = p.next {
+		if p.key == key {
+			return true
+		}
+	}
+	return false
+}
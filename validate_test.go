@@ -0,0 +1,109 @@
+package bottin
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/nbio/st"
+)
+
+func TestValidate(t *testing.T) {
+	msg := new(dns.Msg)
+	msg.SetQuestion("Example.COM.", dns.TypeA)
+	reply := func(f func(resp *dns.Msg)) *dns.Msg {
+		resp := new(dns.Msg)
+		resp.SetReply(msg)
+		f(resp)
+		return resp
+	}
+
+	st.Expect(t, validate(msg, reply(func(*dns.Msg) {})), nil)
+	st.Expect(t, validate(msg, reply(func(resp *dns.Msg) { resp.Question[0].Name = "example.com." })), nil)
+	st.Expect(t, validate(msg, reply(func(resp *dns.Msg) { resp.Id++ })) != nil, true)
+	st.Expect(t, validate(msg, reply(func(resp *dns.Msg) { resp.Response = false })) != nil, true)
+	st.Expect(t, validate(msg, reply(func(resp *dns.Msg) { resp.Question = nil })) != nil, true)
+	st.Expect(t, validate(msg, reply(func(resp *dns.Msg) { resp.Question[0].Name = "example.net." })) != nil, true)
+	st.Expect(t, validate(msg, reply(func(resp *dns.Msg) { resp.Question[0].Qtype = dns.TypeAAAA })) != nil, true)
+}
+
+func TestSpoofedResponse(t *testing.T) {
+	n := newTestNetwork()
+	for _, addr := range []string{"216.239.32.10", "216.239.34.10", "216.239.36.10", "216.239.38.10"} {
+		n.Server(addr).Mangle = func(resp *dns.Msg) { resp.Id++ }
+	}
+	r := NewResolver(WithExchanger(n))
+	rrs, trace, err := r.ResolveTrace(context.Background(), "google.com", "A")
+	st.Expect(t, err != nil, true)
+	st.Expect(t, count(rrs.AnswerRRs, func(rr RR) bool { return rr.Type == "A" }), 0)
+	st.Expect(t, trace.Hops[len(trace.Hops)-1].Error, ErrBadResponse.Error())
+}
+
+func TestRandomCase(t *testing.T) {
+	name := "www.example-domain.com."
+	mixed := false
+	for i := 0; i < 10; i++ {
+		randomized := randomCase(name)
+		st.Expect(t, strings.ToLower(randomized), name)
+		mixed = mixed || randomized != name
+	}
+	st.Expect(t, mixed, true)
+}
+
+func TestCaseRandomization(t *testing.T) {
+	n := newTestNetwork()
+	var mutex sync.Mutex
+	var names []string
+	n.Server("216.239.32.10").Mangle = func(resp *dns.Msg) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		names = append(names, resp.Question[0].Name)
+	}
+	r := NewResolver(WithExchanger(n), WithCaseRandomization())
+	for i := 0; i < 10; i++ {
+		_, err := r.ResolveErr(fmt.Sprintf("www%d.google.com", i), "A")
+		st.Expect(t, err, NXDOMAIN)
+	}
+	mixed := 0
+	for _, name := range names {
+		if name != strings.ToLower(name) {
+			mixed++
+		}
+	}
+	st.Expect(t, mixed > 0, true)
+	st.Expect(t, r.infra.no0x20("216.239.32.10"), false)
+}
+
+func TestCaseRandomizationFallback(t *testing.T) {
+	n := newTestNetwork()
+	google := []string{"216.239.32.10", "216.239.34.10", "216.239.36.10", "216.239.38.10"}
+	for _, addr := range google {
+		n.Server(addr).Mangle = func(resp *dns.Msg) {
+			resp.Question[0].Name = strings.ToLower(resp.Question[0].Name)
+		}
+	}
+	r := NewResolver(WithExchanger(n), WithCaseRandomization())
+
+	rrs, err := r.ResolveErr("google.com", "A")
+	st.Expect(t, err, nil)
+	st.Expect(t, count(rrs.AnswerRRs, func(rr RR) bool { return rr.Type == "A" }), 1)
+	// The case mismatch was retried over TCP, which didn't preserve the case either. A query name
+	// randomized to all lowercase goes unnoticed, other names are queried until one isn't.
+	no0x20 := func() int {
+		servers := 0
+		for _, addr := range google {
+			if r.infra.no0x20(addr) {
+				servers++
+			}
+		}
+		return servers
+	}
+	for i := 0; no0x20() == 0 && i < 100; i++ {
+		_, err := r.ResolveErr(fmt.Sprintf("www%d.google.com", i), "A")
+		st.Expect(t, err, NXDOMAIN)
+	}
+	st.Expect(t, no0x20() > 0, true)
+}